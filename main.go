@@ -6,6 +6,7 @@ import (
 	controller "github.com/appuio/grafana-organizations-operator/pkg"
 	grafana "github.com/grafana/grafana-api-golang-client"
 	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 	"net/http"
 	"net/url"
@@ -41,17 +42,105 @@ func main() {
 		grafanaDatasourcePasswordHidden = "***hidden***"
 	}
 	config.GrafanaClearAutoAssignOrg = os.Getenv("GRAFANA_CLEAR_AUTO_ASSIGN_ORG") == "true"
+	config.GrafanaAutoAssignOrgRole = os.Getenv("GRAFANA_AUTO_ASSIGN_ORG_ROLE")
+	config.GrafanaSupportRole = os.Getenv("GRAFANA_SUPPORT_ROLE")
+	config.GrafanaPreProvisionUsers = os.Getenv("GRAFANA_PRE_PROVISION_USERS") == "true"
+	config.GrafanaSyncTeams = os.Getenv("GRAFANA_SYNC_TEAMS") == "true"
+	roleMappingFile := os.Getenv("ROLE_MAPPING_FILE")
+	folderPermissionsFile := os.Getenv("FOLDER_PERMISSIONS_FILE")
+	accessGrantsFile := os.Getenv("ACCESS_GRANTS_FILE")
+	userStateFile := os.Getenv("USER_STATE_FILE")
+	if userDeletionGracePeriod := os.Getenv("USER_DELETION_GRACE_PERIOD"); userDeletionGracePeriod != "" {
+		var err error
+		config.UserDeletionGracePeriod, err = time.ParseDuration(userDeletionGracePeriod)
+		if err != nil {
+			klog.Errorf("Invalid USER_DELETION_GRACE_PERIOD: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	protectedUsers := os.Getenv("PROTECTED_USERS")
+	protectedUserPatterns := os.Getenv("PROTECTED_USER_PATTERNS")
+	protectedAuthModules := os.Getenv("PROTECTED_AUTH_MODULES")
+	managedAuthModules := os.Getenv("MANAGED_AUTH_MODULES")
+
+	identitySourceName := os.Getenv("IDENTITY_SOURCE")
+	if identitySourceName == "" {
+		identitySourceName = "keycloak"
+	}
+	controlApiAdminTeam := os.Getenv("CONTROL_API_ADMIN_TEAM")
+
+	identityFile := os.Getenv("IDENTITY_FILE")
+
+	scimConfig := controller.ScimConfig{}
+	scimConfig.ListenAddress = os.Getenv("SCIM_LISTEN_ADDRESS")
+	scimConfig.Token = os.Getenv("SCIM_TOKEN")
+	scimTokenHidden := ""
+	if scimConfig.Token != "" {
+		scimTokenHidden = "***hidden***"
+	}
+	scimConfig.OrganizationsRoot = os.Getenv("SCIM_ORGANIZATIONS_ROOT")
+	scimConfig.AdminGroup = os.Getenv("SCIM_ADMIN_GROUP")
+	scimConfig.StateFile = os.Getenv("SCIM_STATE_FILE")
+
+	ldapConfig := controller.LdapConfig{}
+	ldapConfig.Url = os.Getenv("LDAP_URL")
+	ldapConfig.StartTLS = os.Getenv("LDAP_START_TLS") == "true"
+	ldapConfig.BindDn = os.Getenv("LDAP_BIND_DN")
+	ldapConfig.BindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	ldapBindPasswordHidden := ""
+	if ldapConfig.BindPassword != "" {
+		ldapBindPasswordHidden = "***hidden***"
+	}
+	ldapConfig.UserBaseDn = os.Getenv("LDAP_USER_BASE_DN")
+	ldapConfig.UserFilter = os.Getenv("LDAP_USER_FILTER")
+	ldapConfig.UsernameAttribute = os.Getenv("LDAP_USERNAME_ATTRIBUTE")
+	ldapConfig.IdAttribute = os.Getenv("LDAP_ID_ATTRIBUTE")
+	ldapConfig.OrganizationMode = os.Getenv("LDAP_ORGANIZATION_MODE")
+	ldapConfig.OrganizationBaseDn = os.Getenv("LDAP_ORGANIZATION_BASE_DN")
+	ldapConfig.OrganizationFilter = os.Getenv("LDAP_ORGANIZATION_FILTER")
+	ldapConfig.OrganizationNameAttribute = os.Getenv("LDAP_ORGANIZATION_NAME_ATTRIBUTE")
+	ldapConfig.OrganizationDisplayNameAttribute = os.Getenv("LDAP_ORGANIZATION_DISPLAY_NAME_ATTRIBUTE")
+	ldapConfig.MemberAttribute = os.Getenv("LDAP_MEMBER_ATTRIBUTE")
+	ldapConfig.AdminGroupDn = os.Getenv("LDAP_ADMIN_GROUP_DN")
 
-	keycloakUrl := os.Getenv("KEYCLOAK_URL")
-	keycloakRealm := os.Getenv("KEYCLOAK_REALM")
-	keycloakUsername := os.Getenv("KEYCLOAK_USERNAME")
-	keycloakPassword := os.Getenv("KEYCLOAK_PASSWORD")
-	keycloakClientId := os.Getenv("KEYCLOAK_CLIENT_ID")
+	keycloakConfig := controller.KeycloakConfig{}
+	keycloakConfig.Url = os.Getenv("KEYCLOAK_URL")
+	keycloakConfig.Realm = os.Getenv("KEYCLOAK_REALM")
+	keycloakConfig.Username = os.Getenv("KEYCLOAK_USERNAME")
+	keycloakConfig.Password = os.Getenv("KEYCLOAK_PASSWORD")
+	keycloakConfig.ClientId = os.Getenv("KEYCLOAK_CLIENT_ID")
+	keycloakConfig.ClientSecret = os.Getenv("KEYCLOAK_CLIENT_SECRET")
+	keycloakConfig.ClientAssertionKeyFile = os.Getenv("KEYCLOAK_CLIENT_ASSERTION_KEY_FILE")
+	keycloakConfig.ClientAssertionKeyId = os.Getenv("KEYCLOAK_CLIENT_ASSERTION_KEY_ID")
+	keycloakConfig.BasePath = os.Getenv("KEYCLOAK_BASE_PATH")
+	keycloakConfig.OrganizationsApi = os.Getenv("KEYCLOAK_ORGANIZATIONS_API") == "true"
 	keycloakPasswordHidden := ""
-	if keycloakPassword != "" {
+	if keycloakConfig.Password != "" {
 		keycloakPasswordHidden = "***hidden***"
 	}
-	keycloakAdminGroupPath := os.Getenv("KEYCLOAK_ADMIN_GROUP_PATH")
+	keycloakClientSecretHidden := ""
+	if keycloakConfig.ClientSecret != "" {
+		keycloakClientSecretHidden = "***hidden***"
+	}
+	keycloakConfig.AdminGroupPath = os.Getenv("KEYCLOAK_ADMIN_GROUP_PATH")
+	keycloakConfig.ServerAdminGroupPath = os.Getenv("KEYCLOAK_SERVER_ADMIN_GROUP_PATH")
+	keycloakConfig.SupportGroupPath = os.Getenv("KEYCLOAK_SUPPORT_GROUP_PATH")
+	keycloakConfig.AutoAssignOrgGroupPath = os.Getenv("KEYCLOAK_AUTO_ASSIGN_ORG_GROUP_PATH")
+	if identitySourceName == "keycloak" && keycloakConfig.AutoAssignOrgGroupPath != "" {
+		// the members of the auto_assign_org_id organization are managed via this group, so everybody else must be removed
+		config.GrafanaClearAutoAssignOrg = true
+	}
+	keycloakConfig.RoleAttribute = os.Getenv("KEYCLOAK_ROLE_ATTRIBUTE")
+	keycloakConfig.FolderAttribute = os.Getenv("KEYCLOAK_FOLDER_ATTRIBUTE")
+	keycloakConfig.ExpiresAttribute = os.Getenv("KEYCLOAK_EXPIRES_ATTRIBUTE")
+	if fullSyncInterval := os.Getenv("KEYCLOAK_FULL_SYNC_INTERVAL"); fullSyncInterval != "" {
+		var err error
+		keycloakConfig.FullSyncInterval, err = time.ParseDuration(fullSyncInterval)
+		if err != nil {
+			klog.Errorf("Invalid KEYCLOAK_FULL_SYNC_INTERVAL: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	klog.Infof("GRAFANA_URL:                         %s\n", grafanaUrl)
 	klog.Infof("GRAFANA_USERNAME:                    %s\n", grafanaUsername)
@@ -60,19 +149,60 @@ func main() {
 	klog.Infof("GRAFANA_DATASOURCE_USERNAME:         %s\n", config.GrafanaDatasourceUsername)
 	klog.Infof("GRAFANA_DATASOURCE_PASSWORD:         %s\n", grafanaDatasourcePasswordHidden)
 	klog.Infof("GRAFANA_CLEAR_AUTO_ASSIGN_ORG:       %t\n", config.GrafanaClearAutoAssignOrg)
-	klog.Infof("KEYCLOAK_URL:                        %s\n", keycloakUrl)
-	klog.Infof("KEYCLOAK_REALM:                      %s\n", keycloakRealm)
-	klog.Infof("KEYCLOAK_USERNAME:                   %s\n", keycloakUsername)
+	klog.Infof("GRAFANA_SYNC_TEAMS:                  %t\n", config.GrafanaSyncTeams)
+	klog.Infof("GRAFANA_PRE_PROVISION_USERS:         %t\n", config.GrafanaPreProvisionUsers)
+	klog.Infof("ROLE_MAPPING_FILE:                   %s\n", roleMappingFile)
+	klog.Infof("GRAFANA_AUTO_ASSIGN_ORG_ROLE:        %s\n", config.GrafanaAutoAssignOrgRole)
+	klog.Infof("GRAFANA_SUPPORT_ROLE:                %s\n", config.GrafanaSupportRole)
+	klog.Infof("FOLDER_PERMISSIONS_FILE:             %s\n", folderPermissionsFile)
+	klog.Infof("ACCESS_GRANTS_FILE:                  %s\n", accessGrantsFile)
+	klog.Infof("USER_DELETION_GRACE_PERIOD:          %s\n", config.UserDeletionGracePeriod)
+	klog.Infof("USER_STATE_FILE:                     %s\n", userStateFile)
+	klog.Infof("PROTECTED_USERS:                     %s\n", protectedUsers)
+	klog.Infof("PROTECTED_USER_PATTERNS:             %s\n", protectedUserPatterns)
+	klog.Infof("PROTECTED_AUTH_MODULES:              %s\n", protectedAuthModules)
+	klog.Infof("MANAGED_AUTH_MODULES:                %s\n", managedAuthModules)
+	klog.Infof("IDENTITY_SOURCE:                     %s\n", identitySourceName)
+	klog.Infof("IDENTITY_FILE:                       %s\n", identityFile)
+	klog.Infof("KEYCLOAK_URL:                        %s\n", keycloakConfig.Url)
+	klog.Infof("KEYCLOAK_REALM:                      %s\n", keycloakConfig.Realm)
+	klog.Infof("KEYCLOAK_USERNAME:                   %s\n", keycloakConfig.Username)
 	klog.Infof("KEYCLOAK_PASSWORD:                   %s\n", keycloakPasswordHidden)
-	klog.Infof("KEYCLOAK_CLIENT_ID:                  %s\n", keycloakClientId)
-	klog.Infof("KEYCLOAK_ADMIN_GROUP_PATH:           %s\n", keycloakAdminGroupPath)
-
-	keycloakClient, err := controller.NewKeycloakClient(keycloakUrl, keycloakRealm, keycloakUsername, keycloakPassword, keycloakClientId, keycloakAdminGroupPath)
-	if err != nil {
-		klog.Errorf("Could not create keycloakClient client: %v\n", err)
-		os.Exit(1)
-	}
-	defer keycloakClient.CloseIdleConnections()
+	klog.Infof("KEYCLOAK_CLIENT_ID:                  %s\n", keycloakConfig.ClientId)
+	klog.Infof("KEYCLOAK_CLIENT_SECRET:              %s\n", keycloakClientSecretHidden)
+	klog.Infof("KEYCLOAK_CLIENT_ASSERTION_KEY_FILE:  %s\n", keycloakConfig.ClientAssertionKeyFile)
+	klog.Infof("KEYCLOAK_CLIENT_ASSERTION_KEY_ID:    %s\n", keycloakConfig.ClientAssertionKeyId)
+	klog.Infof("KEYCLOAK_BASE_PATH:                  %s\n", keycloakConfig.BasePath)
+	klog.Infof("KEYCLOAK_ORGANIZATIONS_API:          %t\n", keycloakConfig.OrganizationsApi)
+	klog.Infof("KEYCLOAK_ADMIN_GROUP_PATH:           %s\n", keycloakConfig.AdminGroupPath)
+	klog.Infof("KEYCLOAK_SERVER_ADMIN_GROUP_PATH:    %s\n", keycloakConfig.ServerAdminGroupPath)
+	klog.Infof("KEYCLOAK_SUPPORT_GROUP_PATH:         %s\n", keycloakConfig.SupportGroupPath)
+	klog.Infof("KEYCLOAK_AUTO_ASSIGN_ORG_GROUP_PATH: %s\n", keycloakConfig.AutoAssignOrgGroupPath)
+	klog.Infof("KEYCLOAK_ROLE_ATTRIBUTE:             %s\n", keycloakConfig.RoleAttribute)
+	klog.Infof("KEYCLOAK_FOLDER_ATTRIBUTE:           %s\n", keycloakConfig.FolderAttribute)
+	klog.Infof("KEYCLOAK_EXPIRES_ATTRIBUTE:          %s\n", keycloakConfig.ExpiresAttribute)
+	klog.Infof("KEYCLOAK_FULL_SYNC_INTERVAL:         %s\n", keycloakConfig.FullSyncInterval)
+	klog.Infof("CONTROL_API_ADMIN_TEAM:              %s\n", controlApiAdminTeam)
+	klog.Infof("LDAP_URL:                            %s\n", ldapConfig.Url)
+	klog.Infof("LDAP_START_TLS:                      %t\n", ldapConfig.StartTLS)
+	klog.Infof("LDAP_BIND_DN:                        %s\n", ldapConfig.BindDn)
+	klog.Infof("LDAP_BIND_PASSWORD:                  %s\n", ldapBindPasswordHidden)
+	klog.Infof("LDAP_USER_BASE_DN:                   %s\n", ldapConfig.UserBaseDn)
+	klog.Infof("LDAP_USER_FILTER:                    %s\n", ldapConfig.UserFilter)
+	klog.Infof("LDAP_USERNAME_ATTRIBUTE:             %s\n", ldapConfig.UsernameAttribute)
+	klog.Infof("LDAP_ID_ATTRIBUTE:                   %s\n", ldapConfig.IdAttribute)
+	klog.Infof("LDAP_ORGANIZATION_MODE:              %s\n", ldapConfig.OrganizationMode)
+	klog.Infof("LDAP_ORGANIZATION_BASE_DN:           %s\n", ldapConfig.OrganizationBaseDn)
+	klog.Infof("LDAP_ORGANIZATION_FILTER:            %s\n", ldapConfig.OrganizationFilter)
+	klog.Infof("LDAP_ORGANIZATION_NAME_ATTRIBUTE:    %s\n", ldapConfig.OrganizationNameAttribute)
+	klog.Infof("LDAP_ORGANIZATION_DISPLAY_NAME_ATTRIBUTE: %s\n", ldapConfig.OrganizationDisplayNameAttribute)
+	klog.Infof("LDAP_MEMBER_ATTRIBUTE:               %s\n", ldapConfig.MemberAttribute)
+	klog.Infof("LDAP_ADMIN_GROUP_DN:                 %s\n", ldapConfig.AdminGroupDn)
+	klog.Infof("SCIM_LISTEN_ADDRESS:                 %s\n", scimConfig.ListenAddress)
+	klog.Infof("SCIM_TOKEN:                          %s\n", scimTokenHidden)
+	klog.Infof("SCIM_ORGANIZATIONS_ROOT:             %s\n", scimConfig.OrganizationsRoot)
+	klog.Infof("SCIM_ADMIN_GROUP:                    %s\n", scimConfig.AdminGroup)
+	klog.Infof("SCIM_STATE_FILE:                     %s\n", scimConfig.StateFile)
 
 	grafanaConfig := grafana.Config{Client: http.DefaultClient, BasicAuth: url.UserPassword(grafanaUsername, grafanaPassword)}
 	grafanaClient, err := controller.NewGrafanaClient(grafanaUrl, grafanaConfig)
@@ -95,21 +225,105 @@ func main() {
 		cancel()
 	}()
 
+	config.ProtectedUsers, err = controller.ParseProtectedUsers(protectedUsers, protectedUserPatterns, protectedAuthModules, managedAuthModules)
+	if err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if roleMappingFile != "" {
+		config.RoleMapping, err = controller.LoadRoleMapping(roleMappingFile)
+		if err != nil {
+			klog.Errorf("Could not load role mapping: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if folderPermissionsFile != "" {
+		config.FolderPermissions, err = controller.LoadFolderPermissionRules(folderPermissionsFile, config.GrafanaSyncTeams)
+		if err != nil {
+			klog.Errorf("Could not load folder permissions: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	config.AccessGrants, err = controller.NewAccessGrants(accessGrantsFile)
+	if err != nil {
+		klog.Errorf("Could not load access grants: %v\n", err)
+		os.Exit(1)
+	}
+
+	config.UserState, err = controller.LoadUserState(userStateFile)
+	if err != nil {
+		klog.Errorf("Could not load user state: %v\n", err)
+		os.Exit(1)
+	}
+
 	dashboards, err := loadDashboards()
 	if err != nil {
 		klog.Errorf("Could not load dashboards: %v\n", err)
 		os.Exit(1)
 	}
 
+	var identitySource controller.IdentitySource
+	switch identitySourceName {
+	case "keycloak":
+		identitySource, err = controller.NewKeycloakClient(keycloakConfig)
+		if err != nil {
+			klog.Errorf("Could not create keycloakClient client: %v\n", err)
+			os.Exit(1)
+		}
+	case "control-api":
+		// uses KUBECONFIG if set, the in-cluster config otherwise
+		restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+		if err != nil {
+			klog.Errorf("Could not load Kubernetes client configuration: %v\n", err)
+			os.Exit(1)
+		}
+		identitySource, err = controller.NewControlApiClient(restConfig, controlApiAdminTeam)
+		if err != nil {
+			klog.Errorf("Could not create control API client: %v\n", err)
+			os.Exit(1)
+		}
+	case "ldap":
+		identitySource, err = controller.NewLdapClient(ldapConfig)
+		if err != nil {
+			klog.Errorf("Could not create LDAP client: %v\n", err)
+			os.Exit(1)
+		}
+	case "file":
+		identitySource, err = controller.NewFileIdentitySource(identityFile)
+		if err != nil {
+			klog.Errorf("Could not load identity file: %v\n", err)
+			os.Exit(1)
+		}
+	case "scim":
+		scimServer, err := controller.NewScimServer(scimConfig)
+		if err != nil {
+			klog.Errorf("Could not create SCIM server: %v\n", err)
+			os.Exit(1)
+		}
+		scimServer.Start(ctx)
+		identitySource = scimServer
+	default:
+		klog.Errorf("Unknown identity source '%s'\n", identitySourceName)
+		os.Exit(1)
+	}
+	defer identitySource.CloseIdleConnections()
+
 	klog.Info("Starting initial sync...")
-	err = controller.Reconcile(ctx, config, keycloakClient, grafanaClient, dashboards)
+	err = controller.Reconcile(ctx, config, identitySource, grafanaClient, dashboards)
 	if err != nil {
-		klog.Errorf("Could not do initial reconciliation: %v\n", err)
-		os.Exit(1)
+		// the SCIM server may not have received any data yet, that's not a reason to give up
+		if identitySourceName != "scim" {
+			klog.Errorf("Could not do initial reconciliation: %v\n", err)
+			os.Exit(1)
+		}
+		klog.Warningf("Initial sync failed: %v\n", err)
 	}
 
 	for {
-		err = controller.Reconcile(ctx, config, keycloakClient, grafanaClient, dashboards)
+		err = controller.Reconcile(ctx, config, identitySource, grafanaClient, dashboards)
 		select {
 		case <-time.After(2 * time.Second):
 		case <-ctx.Done():
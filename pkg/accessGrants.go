@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"fmt"
+	"k8s.io/klog/v2"
+	"os"
+	"sigs.k8s.io/yaml"
+	"time"
+)
+
+// Temporary access to organizations (YAML or JSON file), e.g. for support engineers. The file is read again on every
+// reconciliation, so grants can be added without restarting the operator.
+type AccessGrantsFile struct {
+	Grants []AccessGrant `json:"grants"`
+}
+
+type AccessGrant struct {
+	User         string    `json:"user"`         // username, the user must exist in the identity source
+	Organization string    `json:"organization"` // name of the organization
+	Role         string    `json:"role"`         // Grafana role, the role mapping decides if empty
+	Expires      time.Time `json:"expires"`      // RFC 3339 timestamp, e.g. "2024-05-01T18:00:00Z"
+}
+
+func LoadAccessGrants(filename string) ([]AccessGrant, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	grantsFile := &AccessGrantsFile{}
+	err = yaml.UnmarshalStrict(content, grantsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse access grants file '%s': %v", filename, err)
+	}
+
+	for i := range grantsFile.Grants {
+		grant := &grantsFile.Grants[i]
+		if grant.User == "" || grant.Organization == "" {
+			return nil, fmt.Errorf("User or organization missing in grant %d of access grants file", i+1)
+		}
+		if grant.Expires.IsZero() {
+			return nil, fmt.Errorf("Expiry missing in grant %d of access grants file, grants must expire", i+1)
+		}
+		if grant.Role != "" {
+			role := normalizeRole(grant.Role)
+			if role == "" {
+				return nil, fmt.Errorf("Invalid role '%s' in grant %d of access grants file", grant.Role, i+1)
+			}
+			grant.Role = role
+		}
+	}
+	return grantsFile.Grants, nil
+}
+
+// Memberships which expire, either from the access grants file or from the identity source (see Membership.Expires).
+// Remembers the grants seen during the last reconciliation, so that every grant and its expiry is logged only once and
+// the affected organizations are reconciled even if the identity source reports no changes.
+type AccessGrants struct {
+	filename string
+	grants   map[accessGrantKey]bool // value is true if the grant has expired
+}
+
+type accessGrantKey struct {
+	user         string
+	organization string
+	team         string
+	expires      int64
+}
+
+// filename may be empty if grants only come from the identity source
+func NewAccessGrants(filename string) (*AccessGrants, error) {
+	if filename != "" {
+		// fail early on startup, later errors only prevent the reconciliation
+		_, err := LoadAccessGrants(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &AccessGrants{
+		filename: filename,
+		grants:   make(map[accessGrantKey]bool),
+	}, nil
+}
+
+// Adds the grants of the file to the snapshot and removes all expired memberships from it
+func (this *AccessGrants) apply(snapshot *IdentitySnapshot, now time.Time) error {
+	if this == nil {
+		snapshot.dropExpiredMemberships(now)
+		return nil
+	}
+
+	if this.filename != "" {
+		grants, err := LoadAccessGrants(this.filename)
+		if err != nil {
+			return err
+		}
+		snapshot.addAccessGrants(grants)
+	}
+
+	grants := make(map[accessGrantKey]bool)
+	for user, memberships := range snapshot.Memberships {
+		for _, membership := range memberships {
+			if membership.Expires.IsZero() {
+				continue
+			}
+			key := accessGrantKey{user: user.Username, organization: membership.Organization.Name, team: membership.Team, expires: membership.Expires.Unix()}
+			expired := !now.Before(membership.Expires)
+			grants[key] = expired
+
+			if wasExpired, ok := this.grants[key]; ok && wasExpired == expired {
+				continue
+			}
+			if expired {
+				klog.Infof("Access of user '%s' to org '%s' expired at %s, revoking", user.Username, membership.Organization.Name, membership.Expires.Format(time.RFC3339))
+			} else {
+				klog.Infof("Access of user '%s' to org '%s' granted until %s", user.Username, membership.Organization.Name, membership.Expires.Format(time.RFC3339))
+			}
+			snapshot.markChanged(membership.Organization.Name)
+		}
+	}
+	extended := make(map[accessGrantKey]bool)
+	for key := range grants {
+		extended[accessGrantKey{user: key.user, organization: key.organization, team: key.team}] = true
+	}
+	for key, expired := range this.grants {
+		if _, ok := grants[key]; !ok {
+			// a grant with a different expiry has already been logged above
+			if !expired && !extended[accessGrantKey{user: key.user, organization: key.organization, team: key.team}] {
+				klog.Infof("Access of user '%s' to org '%s' has been withdrawn before it expired, revoking", key.user, key.organization)
+			}
+			snapshot.markChanged(key.organization)
+		}
+	}
+	this.grants = grants
+
+	snapshot.dropExpiredMemberships(now)
+	return nil
+}
+
+func (this *IdentitySnapshot) addAccessGrants(grants []AccessGrant) {
+	usersByName := make(map[string]*User)
+	for _, user := range this.Users {
+		usersByName[user.Username] = user
+	}
+	organizationsByName := make(map[string]*Organization)
+	for _, organization := range this.Organizations {
+		organizationsByName[organization.Name] = organization
+	}
+
+	for _, grant := range grants {
+		// users who never logged in to Grafana don't need access yet
+		user, ok := usersByName[grant.User]
+		if !ok {
+			continue
+		}
+		organization, ok := organizationsByName[grant.Organization]
+		if !ok {
+			klog.Warningf("Organization '%s' of the access grant for user '%s' not found, ignoring grant", grant.Organization, grant.User)
+			continue
+		}
+		this.Memberships[user] = append(this.Memberships[user], &Membership{Organization: organization, Role: grant.Role, Expires: grant.Expires})
+	}
+}
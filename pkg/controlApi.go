@@ -4,13 +4,62 @@ import (
 	"context"
 	orgs "github.com/appuio/control-api/apis/organization/v1"
 	controlapi "github.com/appuio/control-api/apis/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"strings"
 )
 
+// Reads organizations, users and memberships from the APPUiO control API.
+// Members of an organization are the users referenced by the OrganizationMembers and Team objects in the organization's namespace.
+type ControlApiClient struct {
+	organizationAppuioIoClient *rest.RESTClient
+	appuioIoClient             *rest.RESTClient
+	adminTeam                  string
+}
+
+// The admin team is given as "[ORGNAME]/[TEAMNAME]", members of this team have "Admin" permissions on all organizations.
+func NewControlApiClient(restConfig *rest.Config, adminTeam string) (*ControlApiClient, error) {
+	scheme := runtime.NewScheme()
+	err := orgs.AddToScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	err = controlapi.AddToScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	organizationAppuioIoClient, err := newControlApiRestClient(restConfig, scheme, orgs.GroupVersion)
+	if err != nil {
+		return nil, err
+	}
+	appuioIoClient, err := newControlApiRestClient(restConfig, scheme, controlapi.GroupVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ControlApiClient{
+		organizationAppuioIoClient: organizationAppuioIoClient,
+		appuioIoClient:             appuioIoClient,
+		adminTeam:                  strings.Trim(adminTeam, "/"),
+	}, nil
+}
+
+func newControlApiRestClient(restConfig *rest.Config, scheme *runtime.Scheme, groupVersion schema.GroupVersion) (*rest.RESTClient, error) {
+	config := rest.CopyConfig(restConfig)
+	config.GroupVersion = &groupVersion
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.NewCodecFactory(scheme).WithoutConversion()
+	return rest.RESTClientFor(config)
+}
+
 // Generate list of control API organizations
 func getControlApiOrganizations(ctx context.Context, organizationAppuioIoClient *rest.RESTClient) ([]orgs.Organization, error) {
 	controlApiOrgs := orgs.OrganizationList{}
-	err := organizationAppuioIoClient.Get().Resource("Organizations").Do(ctx).Into(&controlApiOrgs)
+	err := organizationAppuioIoClient.Get().Resource("organizations").Do(ctx).Into(&controlApiOrgs)
 	if err != nil {
 		return nil, err
 	}
@@ -24,7 +73,7 @@ func getControlApiOrganizations(ctx context.Context, organizationAppuioIoClient
 // Generate map containing all control API users. Key is the user ID, value is the user object.
 func getControlApiUsersMap(ctx context.Context, appuioIoClient *rest.RESTClient) (map[string]controlapi.User, error) {
 	controlApiUsers := controlapi.UserList{}
-	err := appuioIoClient.Get().Resource("Users").Do(ctx).Into(&controlApiUsers)
+	err := appuioIoClient.Get().Resource("users").Do(ctx).Into(&controlApiUsers)
 	if err != nil {
 		return nil, err
 	}
@@ -34,3 +83,113 @@ func getControlApiUsersMap(ctx context.Context, appuioIoClient *rest.RESTClient)
 	}
 	return appuioControlApiUsersMap, nil
 }
+
+// Generate list of the members of all organizations. The namespace of each object is the organization name.
+func getControlApiOrganizationMembers(ctx context.Context, appuioIoClient *rest.RESTClient) ([]controlapi.OrganizationMembers, error) {
+	controlApiMembers := controlapi.OrganizationMembersList{}
+	err := appuioIoClient.Get().Resource("organizationmembers").Do(ctx).Into(&controlApiMembers)
+	if err != nil {
+		return nil, err
+	}
+	return controlApiMembers.Items, nil
+}
+
+// Generate list of the teams of all organizations. The namespace of each object is the organization name.
+func getControlApiTeams(ctx context.Context, appuioIoClient *rest.RESTClient) ([]controlapi.Team, error) {
+	controlApiTeams := controlapi.TeamList{}
+	err := appuioIoClient.Get().Resource("teams").Do(ctx).Into(&controlApiTeams)
+	if err != nil {
+		return nil, err
+	}
+	return controlApiTeams.Items, nil
+}
+
+// ControlApiClient implements IdentitySource
+
+func (this *ControlApiClient) GetUsers(ctx context.Context) ([]*User, error) {
+	controlApiUsersMap, err := getControlApiUsersMap(ctx, this.appuioIoClient)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(controlApiUsersMap))
+	for name, controlApiUser := range controlApiUsersMap {
+		users = append(users, &User{
+			Id:        controlApiUser.Status.ID,
+			Username:  name,
+			Email:     controlApiUser.Status.Email,
+			FirstName: controlApiUser.Status.DisplayName, // the control API only knows the full name
+		})
+	}
+	return users, nil
+}
+
+func (this *ControlApiClient) GetSnapshot(ctx context.Context, users []*User) (*IdentitySnapshot, error) {
+	klog.Infof("Fetching organizations from control API...")
+	controlApiOrgs, err := getControlApiOrganizations(ctx, this.organizationAppuioIoClient)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Fetching organization and team members from control API...")
+	controlApiMembers, err := getControlApiOrganizationMembers(ctx, this.appuioIoClient)
+	if err != nil {
+		return nil, err
+	}
+	controlApiTeams, err := getControlApiTeams(ctx, this.appuioIoClient)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &IdentitySnapshot{
+		Users:       users,
+		Memberships: make(map[*User][]*Membership),
+	}
+
+	organizations := make(map[string]*Organization)
+	for _, org := range controlApiOrgs {
+		organization := &Organization{
+			Name:        org.Name,
+			DisplayName: org.Spec.DisplayName,
+		}
+		organizations[organization.Name] = organization
+		snapshot.Organizations = append(snapshot.Organizations, organization)
+	}
+
+	usersMap := make(map[string]*User)
+	for _, user := range users {
+		usersMap[user.Username] = user
+	}
+
+	addMembers := func(organizationName string, team string, userRefs []controlapi.UserRef) {
+		organization, ok := organizations[organizationName]
+		if !ok {
+			return
+		}
+		for _, userRef := range userRefs {
+			if user, ok := usersMap[userRef.Name]; ok {
+				snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization, Team: team})
+			}
+		}
+	}
+	for _, members := range controlApiMembers {
+		addMembers(members.Namespace, "", members.Spec.UserRefs)
+	}
+	for _, team := range controlApiTeams {
+		if organization, ok := organizations[team.Namespace]; ok {
+			organization.Teams = append(organization.Teams, &Team{Name: team.Name, DisplayName: team.Spec.DisplayName})
+		}
+		addMembers(team.Namespace, team.Name, team.Spec.UserRefs)
+		if this.adminTeam == team.Namespace+"/"+team.Name {
+			for _, userRef := range team.Spec.UserRefs {
+				if user, ok := usersMap[userRef.Name]; ok {
+					snapshot.Admins = append(snapshot.Admins, user)
+				}
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (this *ControlApiClient) CloseIdleConnections() {
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/klog/v2"
+	"os"
+	"sigs.k8s.io/yaml"
+	"sync"
+	"time"
+)
+
+// Structure of the identity file (YAML or JSON)
+type IdentityFile struct {
+	Users         []IdentityFileUser         `json:"users"`
+	Organizations []IdentityFileOrganization `json:"organizations"`
+	Admins        []string                   `json:"admins"` // usernames
+}
+
+type IdentityFileUser struct {
+	Id        string `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+type IdentityFileOrganization struct {
+	Name        string             `json:"name"`
+	DisplayName string             `json:"displayName"`
+	Members     []string           `json:"members"` // usernames
+	Teams       []IdentityFileTeam `json:"teams"`
+}
+
+type IdentityFileTeam struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"displayName"`
+	Members     []string `json:"members"` // usernames
+	Folders     []string `json:"folders"` // "[FOLDER]" or "[FOLDER]:[PERMISSION]"
+}
+
+// Identity source reading everything from a local file. The file is read again whenever it changes.
+type FileIdentitySource struct {
+	path    string
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	data    *IdentityFile
+}
+
+func NewFileIdentitySource(path string) (*FileIdentitySource, error) {
+	if path == "" {
+		return nil, errors.New("Identity file path missing")
+	}
+	source := &FileIdentitySource{path: path}
+	_, err := source.load()
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Returns the current content of the file, reading it again if it has been changed since it was last read
+func (this *FileIdentitySource) load() (*IdentityFile, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	fileInfo, err := os.Stat(this.path)
+	if err != nil {
+		return nil, err
+	}
+	if this.data != nil && fileInfo.ModTime().Equal(this.modTime) && fileInfo.Size() == this.size {
+		return this.data, nil
+	}
+
+	content, err := os.ReadFile(this.path)
+	if err != nil {
+		return nil, err
+	}
+	data := &IdentityFile{}
+	err = yaml.UnmarshalStrict(content, data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse identity file '%s': %v", this.path, err)
+	}
+
+	klog.Infof("Loaded identity file '%s'", this.path)
+	this.data = data
+	this.modTime = fileInfo.ModTime()
+	this.size = fileInfo.Size()
+	return this.data, nil
+}
+
+// FileIdentitySource implements IdentitySource
+
+func (this *FileIdentitySource) GetUsers(ctx context.Context) ([]*User, error) {
+	data, err := this.load()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(data.Users))
+	for _, fileUser := range data.Users {
+		users = append(users, &User{
+			Id:        fileUser.Id,
+			Username:  fileUser.Username,
+			Email:     fileUser.Email,
+			FirstName: fileUser.FirstName,
+			LastName:  fileUser.LastName,
+		})
+	}
+	return users, nil
+}
+
+func (this *FileIdentitySource) GetSnapshot(ctx context.Context, users []*User) (*IdentitySnapshot, error) {
+	data, err := this.load()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &IdentitySnapshot{
+		Users:       users,
+		Memberships: make(map[*User][]*Membership),
+	}
+
+	usersMap := make(map[string]*User)
+	for _, user := range users {
+		usersMap[user.Username] = user
+	}
+
+	for _, fileOrganization := range data.Organizations {
+		organization := &Organization{
+			Name:        fileOrganization.Name,
+			DisplayName: fileOrganization.DisplayName,
+		}
+		snapshot.Organizations = append(snapshot.Organizations, organization)
+
+		for _, username := range fileOrganization.Members {
+			if user, ok := usersMap[username]; ok {
+				snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization})
+			}
+		}
+		for _, fileTeam := range fileOrganization.Teams {
+			team := &Team{Name: fileTeam.Name, DisplayName: fileTeam.DisplayName}
+			for _, value := range fileTeam.Folders {
+				if folderPermission := parseFolderPermission(value); folderPermission != nil {
+					team.FolderPermissions = append(team.FolderPermissions, folderPermission)
+				}
+			}
+			organization.Teams = append(organization.Teams, team)
+			for _, username := range fileTeam.Members {
+				if user, ok := usersMap[username]; ok {
+					snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization, Team: fileTeam.Name})
+				}
+			}
+		}
+	}
+
+	for _, username := range data.Admins {
+		if user, ok := usersMap[username]; ok {
+			snapshot.Admins = append(snapshot.Admins, user)
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (this *FileIdentitySource) CloseIdleConnections() {
+}
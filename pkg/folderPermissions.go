@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// Grafana folder permission levels
+var grafanaFolderPermissions = map[string]int64{
+	"View":  1,
+	"Edit":  2,
+	"Admin": 4,
+}
+
+// Folders with restricted permissions (YAML or JSON file). The permissions of these folders are set to exactly the listed ones.
+type FolderPermissionRules struct {
+	Folders []FolderPermissionRule `json:"folders"`
+}
+
+type FolderPermissionRule struct {
+	Organization string                     `json:"organization"` // glob pattern matching the organization name, all organizations if empty
+	Folder       string                     `json:"folder"`       // title of the folder, it's created if it doesn't exist
+	Permissions  []FolderPermissionRuleItem `json:"permissions"`
+}
+
+// Either Team or Role must be set
+type FolderPermissionRuleItem struct {
+	Team       string `json:"team"` // name of the team within the organization, requires team sync
+	Role       string `json:"role"` // "Viewer" or "Editor", admins always have full access
+	Permission string `json:"permission"`
+}
+
+// Team permissions are only valid if the teams are synced to Grafana teams, see Config.GrafanaSyncTeams
+func LoadFolderPermissionRules(filename string, syncTeams bool) (*FolderPermissionRules, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules := &FolderPermissionRules{}
+	err = yaml.UnmarshalStrict(content, rules)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse folder permissions file '%s': %v", filename, err)
+	}
+
+	for i, rule := range rules.Folders {
+		if rule.Folder == "" {
+			return nil, fmt.Errorf("Folder missing in rule %d of folder permissions file", i+1)
+		}
+		if _, err := path.Match(rule.Organization, ""); err != nil {
+			return nil, fmt.Errorf("Invalid organization pattern '%s' in rule %d of folder permissions file", rule.Organization, i+1)
+		}
+		for _, item := range rule.Permissions {
+			if (item.Team == "") == (item.Role == "") {
+				return nil, fmt.Errorf("Either team or role must be set in the permissions of rule %d of folder permissions file", i+1)
+			}
+			if item.Team != "" && !syncTeams {
+				return nil, fmt.Errorf("Team '%s' in rule %d of folder permissions file requires GRAFANA_SYNC_TEAMS=true", item.Team, i+1)
+			}
+			if item.Role != "" && item.Role != "Viewer" && item.Role != "Editor" {
+				return nil, fmt.Errorf("Invalid role '%s' in rule %d of folder permissions file, must be 'Viewer' or 'Editor'", item.Role, i+1)
+			}
+			if _, ok := grafanaFolderPermissions[item.Permission]; !ok {
+				return nil, fmt.Errorf("Invalid permission '%s' in rule %d of folder permissions file, must be 'View', 'Edit' or 'Admin'", item.Permission, i+1)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Parses folder permissions of a team given as "[FOLDER]" (view permission) or "[FOLDER]:[PERMISSION]", returns nil if invalid
+func parseFolderPermission(value string) *FolderPermission {
+	value = strings.TrimSpace(value)
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		if _, ok := grafanaFolderPermissions[value[i+1:]]; ok {
+			value, permission := strings.TrimSpace(value[:i]), value[i+1:]
+			if value == "" {
+				return nil
+			}
+			return &FolderPermission{Folder: value, Permission: permission}
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	return &FolderPermission{Folder: value, Permission: "View"}
+}
+
+// Desired permissions of the folders of an organization, key is the folder title
+func (this *FolderPermissionRules) getOrgFolderPermissions(organization *Organization) map[string][]FolderPermissionRuleItem {
+	folders := make(map[string][]FolderPermissionRuleItem)
+	if this != nil {
+		for _, rule := range this.Folders {
+			if rule.Organization != "" {
+				if matched, _ := path.Match(rule.Organization, organization.Name); !matched {
+					continue
+				}
+			}
+			folders[rule.Folder] = append(folders[rule.Folder], rule.Permissions...)
+		}
+	}
+	for _, team := range organization.Teams {
+		for _, folderPermission := range team.FolderPermissions {
+			folders[folderPermission.Folder] = append(folders[folderPermission.Folder], FolderPermissionRuleItem{Team: team.Name, Permission: folderPermission.Permission})
+		}
+	}
+	return folders
+}
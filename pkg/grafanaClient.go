@@ -66,10 +66,10 @@ func (this *GrafanaClient) GetUserOrgs(user grafana.User) ([]UserOrg, error) {
 	password, _ := this.config.BasicAuth.Password()
 	req.SetBasicAuth(this.config.BasicAuth.Username(), password)
 	r, err := this.client.Do(req)
-	defer r.Body.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer r.Body.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -94,10 +94,10 @@ func (this *GrafanaClient) GetAutoAssignOrgId() (int64, error) {
 	password, _ := this.config.BasicAuth.Password()
 	req.SetBasicAuth(this.config.BasicAuth.Username(), password)
 	r, err := this.client.Do(req)
-	defer r.Body.Close()
 	if err != nil {
 		return 0, err
 	}
+	defer r.Body.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -121,6 +121,37 @@ func (this *GrafanaClient) GetAutoAssignOrgId() (int64, error) {
 	return 0, errors.New("setting users.auto_assign_org_id not found")
 }
 
+// Disabled users can't log in, but keep their settings and permissions. Also missing in the grafana-api-golang-client.
+func (this *GrafanaClient) DisableUser(id int64) error {
+	return this.postUserAction(id, "disable")
+}
+
+func (this *GrafanaClient) EnableUser(id int64) error {
+	return this.postUserAction(id, "enable")
+}
+
+func (this *GrafanaClient) postUserAction(id int64, action string) error {
+	url := this.baseURL
+	url.Path = fmt.Sprintf("/api/admin/users/%d/%s", id, action)
+	req, err := http.NewRequest("POST", url.String(), nil)
+	if err != nil {
+		return err
+	}
+	password, _ := this.config.BasicAuth.Password()
+	req.SetBasicAuth(this.config.BasicAuth.Username(), password)
+	r, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(r.Body)
+		return fmt.Errorf("Could not %s user %d: status %d, %s", action, id, r.StatusCode, body)
+	}
+	return nil
+}
+
 func (this *GrafanaClient) CloseIdleConnections() {
 	this.client.CloseIdleConnections()
 }
@@ -153,6 +184,10 @@ func (this *GrafanaClient) UserUpdate(u grafana.User) error {
 	return this.grafanaClient.UserUpdate(u)
 }
 
+func (this *GrafanaClient) UpdateUserPermissions(id int64, isAdmin bool) error {
+	return this.grafanaClient.UpdateUserPermissions(id, isAdmin)
+}
+
 func (this *GrafanaClient) DeleteUser(id int64) error {
 	return this.grafanaClient.DeleteUser(id)
 }
@@ -221,3 +256,52 @@ func (this *GrafanaClient) Folders(org *grafana.Org) ([]grafana.Folder, error) {
 func (this *GrafanaClient) NewFolder(org *grafana.Org, folderName string) (grafana.Folder, error) {
 	return this.grafanaClient.WithOrgID(org.ID).NewFolder(folderName)
 }
+
+// Ditto
+func (this *GrafanaClient) Teams(org *grafana.Org) ([]*grafana.Team, error) {
+	result, err := this.grafanaClient.WithOrgID(org.ID).SearchTeam("")
+	if err != nil {
+		return nil, err
+	}
+	return result.Teams, nil
+}
+
+// Ditto
+func (this *GrafanaClient) NewTeam(org *grafana.Org, name string) (int64, error) {
+	return this.grafanaClient.WithOrgID(org.ID).AddTeam(name, "")
+}
+
+// Ditto
+func (this *GrafanaClient) UpdateTeam(org *grafana.Org, id int64, name string) error {
+	return this.grafanaClient.WithOrgID(org.ID).UpdateTeam(id, name, "")
+}
+
+// Ditto
+func (this *GrafanaClient) DeleteTeam(org *grafana.Org, id int64) error {
+	return this.grafanaClient.WithOrgID(org.ID).DeleteTeam(id)
+}
+
+// Ditto
+func (this *GrafanaClient) TeamMembers(org *grafana.Org, id int64) ([]*grafana.TeamMember, error) {
+	return this.grafanaClient.WithOrgID(org.ID).TeamMembers(id)
+}
+
+// Ditto
+func (this *GrafanaClient) AddTeamMember(org *grafana.Org, id int64, userID int64) error {
+	return this.grafanaClient.WithOrgID(org.ID).AddTeamMember(id, userID)
+}
+
+// Ditto
+func (this *GrafanaClient) RemoveTeamMember(org *grafana.Org, id int64, userID int64) error {
+	return this.grafanaClient.WithOrgID(org.ID).RemoveMemberFromTeam(id, userID)
+}
+
+// Ditto
+func (this *GrafanaClient) FolderPermissions(org *grafana.Org, uid string) ([]*grafana.FolderPermission, error) {
+	return this.grafanaClient.WithOrgID(org.ID).FolderPermissions(uid)
+}
+
+// Ditto
+func (this *GrafanaClient) UpdateFolderPermissions(org *grafana.Org, uid string, items *grafana.PermissionItems) error {
+	return this.grafanaClient.WithOrgID(org.ID).UpdateFolderPermissions(uid, items)
+}
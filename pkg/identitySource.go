@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"context"
+	"k8s.io/klog/v2"
+	"strings"
+	"time"
+)
+
+// A source of users, organizations and memberships which are mirrored into Grafana.
+// Reconciliation happens in two steps: First all users are fetched and synced to Grafana, then the snapshot is fetched.
+// The snapshot only needs to contain memberships of the users passed to GetSnapshot(), which are the ones present in Grafana
+// (or all users if users are pre-provisioned).
+// This allows sources to skip fetching memberships of users who never logged in to Grafana.
+type IdentitySource interface {
+	GetUsers(ctx context.Context) ([]*User, error)
+	GetSnapshot(ctx context.Context, users []*User) (*IdentitySnapshot, error)
+	CloseIdleConnections()
+}
+
+// Normalized view of the data in an identity source
+type IdentitySnapshot struct {
+	Users         []*User
+	Organizations []*Organization
+	Memberships   map[*User][]*Membership
+	Admins        []*User // Admins have "Admin" permissions on all organizations
+	ServerAdmins  []*User // Server admins are Grafana server administrators, which is independent of organization permissions
+	SupportUsers  []*User // Support users get the support role (see Config.GrafanaSupportRole) on all organizations
+
+	// Members of the Grafana organization configured via auto_assign_org_id. Only used if the operator manages that organization.
+	AutoAssignOrgMembers []*User
+
+	// Names of the organizations whose settings or memberships may have changed since the last snapshot.
+	// nil means that all organizations must be reconciled, which is what most sources do.
+	ChangedOrganizations map[string]bool
+}
+
+type User struct {
+	Id        string // ID in the identity source, may be empty
+	Username  string // Login in Grafana
+	Email     string
+	FirstName string
+	LastName  string
+	Disabled  *bool // Disabled users are disabled in Grafana and don't get any permissions, nil if the source doesn't know
+}
+
+// An organization in the identity source, represented in Grafana as organization "[Name] - [DisplayName]"
+type Organization struct {
+	Name        string
+	DisplayName string
+	Teams       []*Team // Teams referenced by memberships are added automatically, so sources only need to list teams with display names or without members
+}
+
+// A team within an organization, represented in Grafana as team "[Name] - [DisplayName]" within the organization
+type Team struct {
+	Name              string
+	DisplayName       string
+	FolderPermissions []*FolderPermission // Permissions of the team on folders within the organization, requires team sync
+}
+
+type FolderPermission struct {
+	Folder     string // title of the folder
+	Permission string // "View", "Edit" or "Admin"
+}
+
+// Membership of a user in an organization. A user may have several memberships in the same organization, e.g. in multiple teams.
+type Membership struct {
+	Organization *Organization
+	Team         string    // Name of the team within the organization, empty if the user is a direct member of the organization
+	Role         string    // Grafana role granted by the identity source, empty if the role mapping decides
+	Expires      time.Time // Temporary access is revoked at this time, zero if the membership doesn't expire
+}
+
+func (this *User) GetDisplayName() string {
+	if this.FirstName == "" && this.LastName == "" {
+		return this.Email
+	}
+	if this.LastName == "" {
+		return this.FirstName
+	}
+	if this.FirstName == "" {
+		return this.LastName
+	}
+	return this.FirstName + " " + this.LastName
+}
+
+// Users whose state is unknown count as enabled, but their state in Grafana is left as it is, e.g. if an admin disabled them manually
+func (this *User) IsDisabled() bool {
+	return this.Disabled != nil && *this.Disabled
+}
+
+func (this *Organization) GetDisplayName() string {
+	if this.DisplayName != "" {
+		return this.DisplayName
+	}
+	return this.Name
+}
+
+func (this *Team) GetDisplayName() string {
+	if this.DisplayName != "" {
+		return this.DisplayName
+	}
+	return this.Name
+}
+
+func (this *IdentitySnapshot) IsAdmin(user *User) bool {
+	for _, admin := range this.Admins {
+		if admin.Username == user.Username {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *IdentitySnapshot) IsSupportUser(user *User) bool {
+	for _, supportUser := range this.SupportUsers {
+		if supportUser.Username == user.Username {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *IdentitySnapshot) IsServerAdmin(username string) bool {
+	for _, serverAdmin := range this.ServerAdmins {
+		if serverAdmin.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *IdentitySnapshot) IsChanged(organizationName string) bool {
+	return this.ChangedOrganizations == nil || this.ChangedOrganizations[organizationName]
+}
+
+// Makes sure the organization is reconciled even if the source didn't report a change
+func (this *IdentitySnapshot) markChanged(organizationName string) {
+	if this.ChangedOrganizations != nil {
+		this.ChangedOrganizations[organizationName] = true
+	}
+}
+
+func (this *IdentitySnapshot) CountMemberships() int {
+	count := 0
+	for _, memberships := range this.Memberships {
+		count += len(memberships)
+	}
+	return count
+}
+
+// Organization names are used as prefix of the Grafana organization name, which is split at the first space when looking up organizations
+func (this *IdentitySnapshot) dropInvalidOrganizations() {
+	organizations := make([]*Organization, 0, len(this.Organizations))
+	for _, organization := range this.Organizations {
+		if organization.Name == "" || strings.Contains(organization.Name, " ") {
+			klog.Warningf("Organization name '%s' is invalid, ignoring organization", organization.Name)
+			continue
+		}
+		organizations = append(organizations, organization)
+	}
+	this.Organizations = organizations
+}
+
+func (this *IdentitySnapshot) dropExpiredMemberships(now time.Time) {
+	for user, memberships := range this.Memberships {
+		validMemberships := make([]*Membership, 0, len(memberships))
+		for _, membership := range memberships {
+			if membership.Expires.IsZero() || now.Before(membership.Expires) {
+				validMemberships = append(validMemberships, membership)
+			}
+		}
+		this.Memberships[user] = validMemberships
+	}
+}
+
+// Disabled users lose all memberships and admin permissions, they only keep their Grafana user
+func (this *IdentitySnapshot) dropDisabledUsers() {
+	this.dropPermissions(func(user *User) bool { return user.IsDisabled() })
+}
+
+// Users not present in Grafana are removed completely, so that no permissions are granted to them
+func (this *IdentitySnapshot) restrictToUsers(usernames map[string]bool) {
+	this.Users = filterUsers(this.Users, func(user *User) bool { return !usernames[user.Username] })
+	this.dropPermissions(func(user *User) bool { return !usernames[user.Username] })
+}
+
+func (this *IdentitySnapshot) dropPermissions(drop func(user *User) bool) {
+	for user := range this.Memberships {
+		if drop(user) {
+			delete(this.Memberships, user)
+		}
+	}
+	this.Admins = filterUsers(this.Admins, drop)
+	this.ServerAdmins = filterUsers(this.ServerAdmins, drop)
+	this.SupportUsers = filterUsers(this.SupportUsers, drop)
+	this.AutoAssignOrgMembers = filterUsers(this.AutoAssignOrgMembers, drop)
+}
+
+func filterUsers(users []*User, drop func(user *User) bool) []*User {
+	remainingUsers := make([]*User, 0, len(users))
+	for _, user := range users {
+		if !drop(user) {
+			remainingUsers = append(remainingUsers, user)
+		}
+	}
+	return remainingUsers
+}
@@ -11,18 +11,74 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const keycloakPageSize = 100
+
+var keycloakNotFoundError = errors.New("404 Not Found")
+
 type KeycloakClient struct {
-	baseURL        url.URL
-	username       string
-	password       string
-	clientId       string
-	realm          string
-	adminGroupPath string
-	country        string
-	adminGroup     *KeycloakGroup
-	client         *http.Client
+	baseURL                url.URL
+	username               string
+	password               string
+	clientId               string
+	clientSecret           string
+	clientAssertionKey     *clientAssertionKey
+	realm                  string
+	basePath               string
+	basePathDetected       bool
+	basePathLock           sync.Mutex
+	organizationsApi       bool
+	adminGroupPath         string
+	serverAdminGroupPath   string
+	supportGroupPath       string
+	autoAssignOrgGroupPath string
+	roleAttribute          string
+	folderAttribute        string
+	expiresAttribute       string
+	invalidAttributeWarned map[string]bool // invalid attribute values are only logged once
+	country                string
+	client                 *http.Client
+	token                  keycloakToken
+	usersById              map[string]*KeycloakUser // users returned by the last call to GetUsers()
+
+	// Incremental sync based on Keycloak events, see keycloakEvents.go
+	fullSyncInterval   time.Duration
+	lastFullSync       time.Time
+	fullSyncPending    bool                        // GetUsers() did a full sync, GetSnapshot() must do one as well
+	eventsSince        int64                       // time of the newest event processed, in milliseconds since epoch
+	changedUserIds     map[string]bool             // users changed since the last snapshot
+	groupsByUserId     map[string][]*KeycloakGroup // group memberships found in the last snapshot
+	organizationGroups []*KeycloakGroup            // organizations found in the last full sync
+
+	// Organizations API, fetched once per full sync, see keycloakOrganizations.go
+	apiOrganizations              []*KeycloakOrganization
+	apiOrganizationGroupsByUserId map[string][]*KeycloakGroup
+}
+
+// Settings required to connect to Keycloak. Which OAuth2 grant is used depends on which credentials are set:
+// If Username is set the password grant is used, otherwise the client credentials grant (service account) is used.
+// The client authenticates itself with ClientSecret or with a JWT signed with the key in ClientAssertionKeyFile, if set.
+type KeycloakConfig struct {
+	Url                    string
+	Realm                  string
+	Username               string
+	Password               string
+	ClientId               string
+	ClientSecret           string
+	ClientAssertionKeyFile string
+	ClientAssertionKeyId   string
+	BasePath               string // Context path of Keycloak, e.g. "/auth" for Keycloak before version 17. Detected automatically if empty.
+	OrganizationsApi       bool   // Use the Organizations feature of Keycloak 25+ instead of subgroups of "/organizations"
+	AdminGroupPath         string
+	ServerAdminGroupPath   string        // Members of this group are Grafana server admins
+	SupportGroupPath       string        // Members of this group get the support role on all organizations
+	AutoAssignOrgGroupPath string        // Members of this group are members of the Grafana organization configured via auto_assign_org_id
+	RoleAttribute          string        // Group attribute containing the Grafana role of the members of organization and team groups, "grafanaRole" if empty
+	FolderAttribute        string        // Team group attribute containing the folders the members of the team have access to, "grafanaFolders" if empty
+	ExpiresAttribute       string        // Group attribute containing the time (RFC 3339) at which membership in an organization or team group stops granting access, "grafanaExpires" if empty
+	FullSyncInterval       time.Duration // If set, only users and memberships changed according to the Keycloak events are fetched between full syncs
 }
 
 type KeycloakUser struct {
@@ -31,22 +87,38 @@ type KeycloakUser struct {
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
 	Username  string `json:"username"`
+	Enabled   *bool  `json:"enabled"`
 }
 
 type KeycloakGroup struct {
-	Id           string               `json:"id"`
-	Name         string               `json:"name"`
-	Path         string               `json:"path"`
-	SubGroups    []*KeycloakGroup     `json:"subGroups"`
-	Attributes   *map[string][]string `json:"attributes"`
-	pathElements []string             `json:"-"` // transient
+	Id               string               `json:"id"`
+	Name             string               `json:"name"`
+	Path             string               `json:"path"`
+	SubGroups        []*KeycloakGroup     `json:"subGroups"`
+	SubGroupCount    *int                 `json:"subGroupCount"` // only returned by Keycloak 23+, which doesn't inline subgroups
+	Attributes       *map[string][]string `json:"attributes"`
+	pathElements     []string             `json:"-"` // transient
+	subGroupsFetched bool                 `json:"-"` // transient
 }
 
 func (this *KeycloakGroup) GetDisplayNameAttribute() string {
+	return this.GetAttribute("displayName")
+}
+
+// Returns all values of the attribute
+func (this *KeycloakGroup) GetAttributeValues(name string) []string {
+	if this.Attributes != nil {
+		return (*this.Attributes)[name]
+	}
+	return nil
+}
+
+// Returns the first value of the attribute, or "" if the group doesn't have it
+func (this *KeycloakGroup) GetAttribute(name string) string {
 	if this.Attributes != nil {
-		displayNames, ok := (*this.Attributes)["displayName"]
-		if ok && len(displayNames) > 0 {
-			return displayNames[0]
+		values, ok := (*this.Attributes)[name]
+		if ok && len(values) > 0 {
+			return values[0]
 		}
 	}
 	return ""
@@ -63,13 +135,6 @@ func (this *KeycloakGroup) GetPathElements() []string {
 	return this.pathElements
 }
 
-func (this *KeycloakGroup) IsSameOrganization(other *KeycloakGroup) bool {
-	if other == nil {
-		return false
-	}
-	return this.GetPathElements()[0] == other.GetPathElements()[0] && this.GetPathElements()[1] == other.GetPathElements()[1]
-}
-
 func (this *KeycloakGroup) GetOrganizationName() string {
 	if len(this.GetPathElements()) < 2 {
 		return ""
@@ -77,86 +142,173 @@ func (this *KeycloakGroup) GetOrganizationName() string {
 	return this.GetPathElements()[1]
 }
 
-func (this *KeycloakUser) GetDisplayName() string {
-	if this.FirstName == "" && this.LastName == "" {
-		return this.Email
+func NewKeycloakClient(config KeycloakConfig) (*KeycloakClient, error) {
+	u, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Username == "" && config.ClientSecret == "" && config.ClientAssertionKeyFile == "" {
+		return nil, errors.New("Keycloak credentials missing: either a username or a client secret or a client assertion key is required")
+	}
+
+	var assertionKey *clientAssertionKey
+	if config.ClientAssertionKeyFile != "" {
+		assertionKey, err = loadClientAssertionKey(config.ClientAssertionKeyFile, config.ClientAssertionKeyId)
+		if err != nil {
+			return nil, err
+		}
 	}
-	if this.LastName == "" {
-		return this.FirstName
+
+	roleAttribute := config.RoleAttribute
+	if roleAttribute == "" {
+		roleAttribute = "grafanaRole"
 	}
-	if this.FirstName == "" {
-		return this.LastName
+
+	folderAttribute := config.FolderAttribute
+	if folderAttribute == "" {
+		folderAttribute = "grafanaFolders"
 	}
-	return this.FirstName + " " + this.LastName
-}
 
-func NewKeycloakClient(baseURL string, realm string, username string, password string, clientId string, adminGroupPath string) (*KeycloakClient, error) {
-	u, err := url.Parse(baseURL)
-	if err != nil {
-		return nil, err
+	expiresAttribute := config.ExpiresAttribute
+	if expiresAttribute == "" {
+		expiresAttribute = "grafanaExpires"
 	}
 
 	tr := &http.Transport{} // Creating the transport explicitly allows for connection pooling and reuse
 	cli := &http.Client{Transport: tr}
-	if err != nil {
-		return nil, err
-	}
 
 	return &KeycloakClient{
-		baseURL:        *u,
-		client:         cli,
-		realm:          realm,
-		username:       username,
-		password:       password,
-		clientId:       clientId,
-		adminGroupPath: adminGroupPath,
+		baseURL:                *u,
+		client:                 cli,
+		realm:                  config.Realm,
+		username:               config.Username,
+		password:               config.Password,
+		clientId:               config.ClientId,
+		clientSecret:           config.ClientSecret,
+		clientAssertionKey:     assertionKey,
+		basePath:               strings.TrimSuffix(config.BasePath, "/"),
+		basePathDetected:       config.BasePath != "",
+		organizationsApi:       config.OrganizationsApi,
+		adminGroupPath:         config.AdminGroupPath,
+		serverAdminGroupPath:   config.ServerAdminGroupPath,
+		supportGroupPath:       config.SupportGroupPath,
+		autoAssignOrgGroupPath: config.AutoAssignOrgGroupPath,
+		roleAttribute:          roleAttribute,
+		folderAttribute:        folderAttribute,
+		expiresAttribute:       expiresAttribute,
+		invalidAttributeWarned: make(map[string]bool),
+		fullSyncInterval:       config.FullSyncInterval,
 	}, nil
 }
 
-func (this *KeycloakClient) GetToken() (string, error) {
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/auth/realms/%s/protocol/openid-connect/token", this.baseURL.String(), this.realm), nil)
-	if err != nil {
-		return "", err
+// Keycloak up to version 16 serves everything below "/auth", newer versions (Quarkus based) don't use a context path by default.
+// Unless configured explicitly we try both variants and use the one where the OIDC discovery document of the realm can be found.
+func (this *KeycloakClient) getBasePath() (string, error) {
+	this.basePathLock.Lock()
+	defer this.basePathLock.Unlock()
+
+	if this.basePathDetected {
+		return this.basePath, nil
 	}
 
-	req.Header["Accept"] = []string{"application/json"}
-	req.Header["Content-Type"] = []string{"application/x-www-form-urlencoded"}
-	req.Header["cache-control"] = []string{"no-cache"}
+	for _, candidate := range []string{"", "/auth"} {
+		discoveryUrl := fmt.Sprintf("%s%s/realms/%s/.well-known/openid-configuration", this.baseURL.String(), candidate, url.PathEscape(this.realm))
+		r, err := this.client.Get(discoveryUrl)
+		if err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if r.StatusCode != http.StatusOK {
+			continue
+		}
 
-	data := fmt.Sprintf("grant_type=password&username=%s&password=%s&client_id=%s", url.QueryEscape(this.username), url.QueryEscape(this.password), url.QueryEscape(this.clientId))
-	req.Body = io.NopCloser(strings.NewReader(data))
+		var discovery map[string]interface{}
+		err = json.Unmarshal(body, &discovery)
+		if err != nil {
+			continue
+		}
+		if _, ok := discovery["token_endpoint"]; ok {
+			klog.Infof("Detected Keycloak base path '%s'", candidate)
+			this.basePath = candidate
+			this.basePathDetected = true
+			return this.basePath, nil
+		}
+	}
+	return "", fmt.Errorf("Could not detect Keycloak base path: OIDC discovery document of realm '%s' not found, set the base path explicitly", this.realm)
+}
 
-	r, err := this.client.Do(req)
+// URL of the given realm-specific (non-admin) endpoint
+func (this *KeycloakClient) realmUrl(format string, a ...interface{}) (string, error) {
+	basePath, err := this.getBasePath()
 	if err != nil {
 		return "", err
 	}
-	defer r.Body.Close()
+	return fmt.Sprintf("%s%s/realms/%s/", this.baseURL.String(), basePath, url.PathEscape(this.realm)) + fmt.Sprintf(format, a...), nil
+}
 
-	body, err := io.ReadAll(r.Body)
+// URL of the given realm-specific admin REST API endpoint
+func (this *KeycloakClient) adminUrl(format string, a ...interface{}) (string, error) {
+	basePath, err := this.getBasePath()
 	if err != nil {
 		return "", err
 	}
+	return fmt.Sprintf("%s%s/admin/realms/%s/", this.baseURL.String(), basePath, url.PathEscape(this.realm)) + fmt.Sprintf(format, a...), nil
+}
 
-	var objmap map[string]interface{}
-	json.Unmarshal(body, &objmap)
+// Fetch one page of a paginated list
+func (this *KeycloakClient) getJsonPage(path string, first int, target interface{}) error {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	requestUrl, err := this.adminUrl("%s%sfirst=%d&max=%d", path, separator, first, keycloakPageSize)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return err
+	}
 
-	accessToken, ok := objmap["access_token"]
-	if !ok {
-		return "", errors.New("access_token not found in JSON response")
+	req.Header["cache-control"] = []string{"no-cache"}
+
+	r, err := this.doAuthenticated(req)
+	if err != nil {
+		return err
 	}
-	return fmt.Sprintf("%s", accessToken), nil
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("Keycloak request '%s' failed: %w", path, keycloakNotFoundError)
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Keycloak request '%s' failed: %s", path, r.Status)
+	}
+	return json.Unmarshal(body, target)
 }
 
-func (this *KeycloakClient) getUsersCount(token string) (uint32, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/auth/admin/realms/%s/users/count", this.baseURL.String(), this.realm), nil)
+func (this *KeycloakClient) getUsersCount() (uint32, error) {
+	requestUrl, err := this.adminUrl("users/count")
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", requestUrl, nil)
 	if err != nil {
 		return 0, err
 	}
 
-	req.Header["Authorization"] = []string{"Bearer " + token}
 	req.Header["cache-control"] = []string{"no-cache"}
 
-	r, err := this.client.Do(req)
+	r, err := this.doAuthenticated(req)
 	if err != nil {
 		return 0, err
 	}
@@ -175,16 +327,19 @@ func (this *KeycloakClient) getUsersCount(token string) (uint32, error) {
 	return count, nil
 }
 
-func (this *KeycloakClient) getUsers(token string, batchSize uint32, first uint32) ([]*KeycloakUser, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/auth/admin/realms/%s/users?max=%d&first=%d", this.baseURL.String(), this.realm, batchSize, first), nil)
+func (this *KeycloakClient) getUsers(batchSize uint32, first uint32) ([]*KeycloakUser, error) {
+	requestUrl, err := this.adminUrl("users?max=%d&first=%d", batchSize, first)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", requestUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header["Authorization"] = []string{"Bearer " + token}
 	req.Header["cache-control"] = []string{"no-cache"}
 
-	r, err := this.client.Do(req)
+	r, err := this.doAuthenticated(req)
 	if err != nil {
 		return nil, err
 	}
@@ -203,11 +358,11 @@ func (this *KeycloakClient) getUsers(token string, batchSize uint32, first uint3
 	return keycloakUsers, nil
 }
 
-func (this *KeycloakClient) usersWorker(token string, batchSize uint32, firstChan chan uint32, results *sync.Map, errorCount *uint64, wg *sync.WaitGroup) {
+func (this *KeycloakClient) usersWorker(batchSize uint32, firstChan chan uint32, results *sync.Map, errorCount *uint64, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for first := range firstChan {
-		groups, err := this.getUsers(token, batchSize, first)
+		groups, err := this.getUsers(batchSize, first)
 		if err != nil {
 			atomic.AddUint64(errorCount, 1)
 			klog.Error(err)
@@ -216,10 +371,10 @@ func (this *KeycloakClient) usersWorker(token string, batchSize uint32, firstCha
 	}
 }
 
-func (this *KeycloakClient) GetUsers(token string) ([]*KeycloakUser, error) {
+func (this *KeycloakClient) GetKeycloakUsers() ([]*KeycloakUser, error) {
 	// This could be a simple straight fetch of all users, but because of https://github.com/keycloak/keycloak/issues/10005
 	// we need to do parallel fetches to keep the load times reasonable
-	count, err := this.getUsersCount(token)
+	count, err := this.getUsersCount()
 	if err != nil {
 		return nil, err
 	}
@@ -234,7 +389,7 @@ func (this *KeycloakClient) GetUsers(token string) ([]*KeycloakUser, error) {
 	// creating workers
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
-		go this.usersWorker(token, batchSize, firstChan, &results, &errorCount, wg)
+		go this.usersWorker(batchSize, firstChan, &results, &errorCount, wg)
 	}
 
 	// sending batches to workers
@@ -259,74 +414,115 @@ func (this *KeycloakClient) GetUsers(token string) ([]*KeycloakUser, error) {
 	return users, nil
 }
 
-func (this *KeycloakClient) GetGroups(token string) ([]*KeycloakGroup, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/auth/admin/realms/%s/groups?max=100000&briefRepresentation=false", this.baseURL.String(), this.realm), nil)
-	if err != nil {
-		return nil, err
+// Keycloak before version 23 inlines all subgroups, newer versions only return the number of subgroups
+// and the subgroups must be fetched via "groups/[ID]/children". Both variants are supported.
+func (this *KeycloakClient) getTopLevelGroups() ([]*KeycloakGroup, error) {
+	groups := make([]*KeycloakGroup, 0)
+	for first := 0; ; first += keycloakPageSize {
+		page := make([]*KeycloakGroup, 0)
+		err := this.getJsonPage("groups?briefRepresentation=false", first, &page)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, page...)
+		if len(page) < keycloakPageSize {
+			return groups, nil
+		}
 	}
+}
 
-	req.Header["Authorization"] = []string{"Bearer " + token}
-	req.Header["cache-control"] = []string{"no-cache"}
-
-	r, err := this.client.Do(req)
-	if err != nil {
-		return nil, err
+// Returns the direct subgroups of the group, fetching them if they aren't inlined. Fetched subgroups are stored in the group.
+func (this *KeycloakClient) getChildGroups(group *KeycloakGroup) ([]*KeycloakGroup, error) {
+	if group.subGroupsFetched || group.SubGroupCount == nil || len(group.SubGroups) >= *group.SubGroupCount {
+		return group.SubGroups, nil
 	}
-	defer r.Body.Close()
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
+	children := make([]*KeycloakGroup, 0)
+	for first := 0; ; first += keycloakPageSize {
+		page := make([]*KeycloakGroup, 0)
+		err := this.getJsonPage(fmt.Sprintf("groups/%s/children?briefRepresentation=false", url.PathEscape(group.Id)), first, &page)
+		if errors.Is(err, keycloakNotFoundError) {
+			// no children endpoint, the inlined subgroups are all there is
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, page...)
+		if len(page) < keycloakPageSize {
+			break
+		}
 	}
-
-	keycloakGroups := make([]*KeycloakGroup, 0)
-	err = json.Unmarshal(body, &keycloakGroups)
-	if err != nil {
-		return nil, err
+	for _, child := range children {
+		if child.Path == "" {
+			child.Path = group.Path + "/" + child.Name
+		}
 	}
-	return keycloakGroups, nil
+	group.SubGroups = children
+	group.subGroupsFetched = true
+	return children, nil
 }
 
 // This returns all Keycloak groups with two-level path "/organizations/[ORGNAME]", but not "/organizations/[ORGNAME]/[TEAMNAME]"
 // The returned groups may have subgroups (teams), but the subgroups themselves are not part of the list.
-func (this *KeycloakClient) GetOrganizations(token string) ([]*KeycloakGroup, error) {
-	allGroups, err := this.GetGroups(token)
+// If the Keycloak Organizations API is used the organizations are converted into groups with the same path layout, see keycloakOrganizations.go
+// topLevelGroups must be the result of getTopLevelGroups(), it isn't used with the Organizations API.
+func (this *KeycloakClient) GetOrganizationGroups(topLevelGroups []*KeycloakGroup) ([]*KeycloakGroup, error) {
+	if this.organizationsApi {
+		return this.getApiOrganizationGroups()
+	}
+
+	organizationsGroup, err := this.findSubgroup(topLevelGroups, "/organizations")
 	if err != nil {
 		return nil, err
 	}
-
-	for _, group := range allGroups {
-		if group.Path == "/organizations" {
-			return group.SubGroups, nil
-		}
+	if organizationsGroup == nil {
+		klog.Warning("Group '/organizations' not found in Keycloak")
+		return []*KeycloakGroup{}, nil
 	}
 
-	return []*KeycloakGroup{}, nil
+	return this.getChildGroups(organizationsGroup)
 }
 
-func (this *KeycloakClient) findSubgroup(groups []*KeycloakGroup) {
-	for _, group := range groups {
-		if group.Path == this.adminGroupPath {
-			this.adminGroup = group
-			break
+// Finds the group with the given path below the given groups. Only the subgroups along the path are fetched. Returns nil if there's no such group.
+func (this *KeycloakClient) findSubgroup(groups []*KeycloakGroup, path string) (*KeycloakGroup, error) {
+	pathElements := strings.Split(strings.Trim(path, "/"), "/")
+	for depth, name := range pathElements {
+		var found *KeycloakGroup
+		for _, group := range groups {
+			if group.Name == name {
+				found = group
+				break
+			}
 		}
-		this.findSubgroup(group.SubGroups)
-		if this.adminGroup != nil {
-			break
+		if found == nil {
+			return nil, nil
+		}
+		if depth == len(pathElements)-1 {
+			return found, nil
 		}
+		children, err := this.getChildGroups(found)
+		if err != nil {
+			return nil, err
+		}
+		groups = children
 	}
+	return nil, nil
 }
 
-func (this *KeycloakClient) getGroupMembership(token string, user *KeycloakUser) ([]*KeycloakGroup, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/auth/admin/realms/%s/users/%s/groups", this.baseURL.String(), this.realm, user.Id), nil)
+func (this *KeycloakClient) getGroupMembership(user *KeycloakUser) ([]*KeycloakGroup, error) {
+	requestUrl, err := this.adminUrl("users/%s/groups?briefRepresentation=false", user.Id)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", requestUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header["Authorization"] = []string{"Bearer " + token}
 	req.Header["cache-control"] = []string{"no-cache"}
 
-	response, err := this.client.Do(req)
+	response, err := this.doAuthenticated(req)
 	if err != nil {
 		return nil, err
 	}
@@ -345,11 +541,11 @@ func (this *KeycloakClient) getGroupMembership(token string, user *KeycloakUser)
 	return groups, nil
 }
 
-func (this *KeycloakClient) groupMembershipWorker(token string, userChan chan *KeycloakUser, results *sync.Map, errorCount *uint64, wg *sync.WaitGroup) {
+func (this *KeycloakClient) groupMembershipWorker(userChan chan *KeycloakUser, results *sync.Map, errorCount *uint64, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for user := range userChan {
-		groups, err := this.getGroupMembership(token, user)
+		groups, err := this.getGroupMembership(user)
 		if err != nil {
 			atomic.AddUint64(errorCount, 1)
 			klog.Error(err)
@@ -358,7 +554,7 @@ func (this *KeycloakClient) groupMembershipWorker(token string, userChan chan *K
 	}
 }
 
-func (this *KeycloakClient) GetGroupMemberships(token string, users []*KeycloakUser) (map[*KeycloakUser][]*KeycloakGroup, error) {
+func (this *KeycloakClient) GetGroupMemberships(users []*KeycloakUser) (map[*KeycloakUser][]*KeycloakGroup, error) {
 	results := sync.Map{}
 	var errorCount uint64
 
@@ -368,7 +564,7 @@ func (this *KeycloakClient) GetGroupMemberships(token string, users []*KeycloakU
 	// creating workers
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
-		go this.groupMembershipWorker(token, userChan, &results, &errorCount, wg)
+		go this.groupMembershipWorker(userChan, &results, &errorCount, wg)
 	}
 
 	// sending users to workers
@@ -389,6 +585,13 @@ func (this *KeycloakClient) GetGroupMemberships(token string, users []*KeycloakU
 		return true
 	})
 
+	if this.organizationsApi {
+		err := this.addApiOrganizationMemberships(userGroups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return userGroups, nil
 }
 
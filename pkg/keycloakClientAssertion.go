@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers crypto.SHA256
+	_ "crypto/sha512" // registers crypto.SHA384 and crypto.SHA512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Private key used to sign JWT client assertions ("private_key_jwt" client authentication in Keycloak)
+type clientAssertionKey struct {
+	keyId  string
+	signer crypto.Signer
+}
+
+func loadClientAssertionKey(path string, keyId string) (*clientAssertionKey, error) {
+	keyPem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in client assertion key file '%s'", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return &clientAssertionKey{keyId: keyId, signer: key.(crypto.Signer)}, nil
+	}
+	return nil, errors.New("Unsupported client assertion key type, only RSA and EC keys are supported")
+}
+
+// Create a signed JWT identifying the client towards the token endpoint (RFC 7523)
+func (this *clientAssertionKey) sign(clientId string, audience string) (string, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+
+	alg, hash, err := this.algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if this.keyId != "" {
+		header["kid"] = this.keyId
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": clientId,
+		"sub": clientId,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+	}
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	var signature []byte
+	switch key := this.signer.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		if err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		// JWS wants the raw R || S concatenation instead of the ASN.1 encoding
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (this *clientAssertionKey) algorithm() (string, crypto.Hash, error) {
+	switch key := this.signer.(type) {
+	case *rsa.PrivateKey:
+		return "RS256", crypto.SHA256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+	}
+	return "", 0, errors.New("Unsupported client assertion key")
+}
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Admin event as returned by "admin-events". Requires "Save admin events" to be enabled in the realm.
+type KeycloakAdminEvent struct {
+	Time          int64  `json:"time"` // milliseconds since epoch
+	OperationType string `json:"operationType"`
+	ResourceType  string `json:"resourceType"`
+	ResourcePath  string `json:"resourcePath"`
+}
+
+// User event as returned by "events". Requires "Save events" to be enabled in the realm.
+type KeycloakEvent struct {
+	Time   int64  `json:"time"` // milliseconds since epoch
+	Type   string `json:"type"`
+	UserId string `json:"userId"`
+}
+
+// User events that change users without an admin event being recorded
+var keycloakUserEventTypes = []string{"REGISTER", "UPDATE_PROFILE", "UPDATE_EMAIL", "DELETE_ACCOUNT", "IDENTITY_PROVIDER_FIRST_LOGIN"}
+
+// Changes found in the events since the last sync
+type keycloakChanges struct {
+	fullSyncRequired bool            // a change we can't handle incrementally, e.g. a group rename
+	userIds          map[string]bool // users that were created, changed or deleted, or whose group memberships were changed
+	newestEvent      int64
+}
+
+// Keycloak returns the newest events first. We fetch pages until we reach events we've already seen.
+// The "dateFrom" filter only has day granularity in older Keycloak versions, so events are filtered by time here.
+// Events in the same millisecond as the newest event seen are processed again, they might have been stored after the last
+// poll. That's harmless, users are simply fetched again.
+func (this *KeycloakClient) getEventsSince(path string, since int64, handle func(page []json.RawMessage) (int64, error)) error {
+	dateFrom := time.UnixMilli(since).UTC().Add(-24 * time.Hour).Format("2006-01-02")
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	for first := 0; ; first += keycloakPageSize {
+		page := make([]json.RawMessage, 0)
+		err := this.getJsonPage(path+separator+"dateFrom="+dateFrom, first, &page)
+		if err != nil {
+			return err
+		}
+		oldest, err := handle(page)
+		if err != nil {
+			return err
+		}
+		if len(page) < keycloakPageSize || oldest < since {
+			return nil
+		}
+	}
+}
+
+func (this *KeycloakClient) getChangesSince(since int64) (*keycloakChanges, error) {
+	changes := &keycloakChanges{userIds: make(map[string]bool), newestEvent: since}
+
+	err := this.getEventsSince("admin-events", since, func(page []json.RawMessage) (int64, error) {
+		oldest := since
+		for _, raw := range page {
+			event := KeycloakAdminEvent{}
+			err := json.Unmarshal(raw, &event)
+			if err != nil {
+				return 0, err
+			}
+			oldest = event.Time
+			if event.Time < since {
+				continue
+			}
+			if event.Time > changes.newestEvent {
+				changes.newestEvent = event.Time
+			}
+
+			pathElements := strings.Split(event.ResourcePath, "/")
+			switch event.ResourceType {
+			case "USER", "GROUP_MEMBERSHIP":
+				// "users/[ID]" or "users/[ID]/groups/[GROUPID]"
+				if len(pathElements) >= 2 && pathElements[0] == "users" {
+					changes.userIds[pathElements[1]] = true
+				}
+			case "GROUP":
+				// groups can be renamed, moved and deleted, which affects the memberships of all their members
+				changes.fullSyncRequired = true
+			case "ORGANIZATION", "ORGANIZATION_MEMBERSHIP":
+				if this.organizationsApi {
+					changes.fullSyncRequired = true
+				}
+			}
+		}
+		return oldest, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	types := url.Values{"type": keycloakUserEventTypes}
+	err = this.getEventsSince("events?"+types.Encode(), since, func(page []json.RawMessage) (int64, error) {
+		oldest := since
+		for _, raw := range page {
+			event := KeycloakEvent{}
+			err := json.Unmarshal(raw, &event)
+			if err != nil {
+				return 0, err
+			}
+			oldest = event.Time
+			if event.Time < since {
+				continue
+			}
+			if event.Time > changes.newestEvent {
+				changes.newestEvent = event.Time
+			}
+			if event.UserId != "" {
+				changes.userIds[event.UserId] = true
+			}
+		}
+		return oldest, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Returns nil if the user doesn't exist (anymore)
+func (this *KeycloakClient) getUser(id string) (*KeycloakUser, error) {
+	requestUrl, err := this.adminUrl("users/%s", url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header["cache-control"] = []string{"no-cache"}
+
+	r, err := this.doAuthenticated(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch Keycloak user '%s': %s", id, r.Status)
+	}
+
+	user := &KeycloakUser{}
+	err = json.Unmarshal(body, user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Update the users fetched during the last full sync with the changes found in the events.
+// Returns false if a full sync is required.
+func (this *KeycloakClient) updateUsersFromEvents() (bool, error) {
+	changes, err := this.getChangesSince(this.eventsSince)
+	if err != nil {
+		return false, err
+	}
+	if changes.fullSyncRequired {
+		return false, nil
+	}
+
+	for userId := range changes.userIds {
+		user, err := this.getUser(userId)
+		if err != nil {
+			return false, err
+		}
+		if user == nil {
+			delete(this.usersById, userId)
+		} else {
+			this.usersById[userId] = user
+		}
+		this.changedUserIds[userId] = true
+	}
+	this.eventsSince = changes.newestEvent
+	return true, nil
+}
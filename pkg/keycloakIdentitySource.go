@@ -0,0 +1,297 @@
+package controller
+
+import (
+	"context"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// KeycloakClient implements IdentitySource. Organizations are the subgroups of "/organizations" (or the organizations of the
+// Keycloak Organizations API), subgroups of organizations are teams.
+//
+// If a full sync interval is configured, users and memberships are only fetched completely once per interval.
+// In between only the users mentioned in the Keycloak events are fetched again, see keycloakEvents.go.
+
+func (this *KeycloakClient) GetUsers(ctx context.Context) ([]*User, error) {
+	if this.fullSyncInterval > 0 && this.usersById != nil && time.Since(this.lastFullSync) < this.fullSyncInterval {
+		ok, err := this.updateUsersFromEvents()
+		if err != nil {
+			klog.Warningf("Could not process Keycloak events, doing a full sync: %v", err)
+		} else if ok {
+			klog.Infof("Found %d changed users in Keycloak events", len(this.changedUserIds))
+			return this.getCachedUsers(), nil
+		} else {
+			klog.Infof("Keycloak events contain changes to groups, doing a full sync")
+		}
+	}
+
+	start := time.Now()
+	keycloakUsers, err := this.GetKeycloakUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	this.usersById = make(map[string]*KeycloakUser)
+	for _, keycloakUser := range keycloakUsers {
+		this.usersById[keycloakUser.Id] = keycloakUser
+	}
+	this.lastFullSync = start
+	this.fullSyncPending = true
+	this.changedUserIds = make(map[string]bool)
+	// Events that happen while we're fetching are processed again later, which doesn't hurt
+	this.eventsSince = start.Add(-time.Minute).UnixMilli()
+	return this.getCachedUsers(), nil
+}
+
+func (this *KeycloakClient) getCachedUsers() []*User {
+	users := make([]*User, 0, len(this.usersById))
+	for _, keycloakUser := range this.usersById {
+		user := &User{
+			Id:        keycloakUser.Id,
+			Username:  keycloakUser.Username,
+			Email:     keycloakUser.Email,
+			FirstName: keycloakUser.FirstName,
+			LastName:  keycloakUser.LastName,
+		}
+		if keycloakUser.Enabled != nil {
+			disabled := !*keycloakUser.Enabled
+			user.Disabled = &disabled
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+func (this *KeycloakClient) GetSnapshot(ctx context.Context, users []*User) (*IdentitySnapshot, error) {
+	fullSync := this.fullSyncPending || this.groupsByUserId == nil || this.organizationGroups == nil
+
+	// Only users that changed or whose memberships we don't know yet (e.g. because they logged in to Grafana for the first time) are fetched
+	keycloakUsers := make([]*KeycloakUser, 0, len(users))
+	for _, user := range users {
+		keycloakUser, ok := this.usersById[user.Id]
+		if !ok {
+			klog.Warningf("User '%s' unknown, ignoring", user.Username)
+			continue
+		}
+		if _, known := this.groupsByUserId[user.Id]; fullSync || !known || this.changedUserIds[user.Id] {
+			keycloakUsers = append(keycloakUsers, keycloakUser)
+		}
+	}
+
+	if fullSync && this.organizationsApi {
+		klog.Infof("Fetching organizations and their members from Keycloak...")
+		err := this.fetchApiOrganizations()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	klog.Infof("Fetching group memberships of %d users from Keycloak...", len(keycloakUsers))
+	keycloakUserGroups, err := this.GetGroupMemberships(keycloakUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	organizationGroups := this.organizationGroups
+	if fullSync {
+		klog.Infof("Fetching organizations from Keycloak...")
+		// the top level groups are fetched once per sync, all group paths are resolved against them
+		topLevelGroups, err := this.getTopLevelGroups()
+		if err != nil {
+			return nil, err
+		}
+		organizationGroups, err = this.GetOrganizationGroups(topLevelGroups)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range []string{this.adminGroupPath, this.serverAdminGroupPath, this.supportGroupPath, this.autoAssignOrgGroupPath} {
+			if path == "" {
+				continue
+			}
+			group, err := this.findSubgroup(topLevelGroups, path)
+			if err != nil {
+				return nil, err
+			}
+			if group == nil {
+				klog.Warningf("Group '%s' not found in Keycloak", path)
+			}
+		}
+	}
+
+	// Organizations of which a member has been added or removed. If an admin or a support user changed, all organizations are affected.
+	changedOrganizations := make(map[string]bool)
+	addChangedOrganizations := func(groups []*KeycloakGroup) {
+		for _, group := range groups {
+			if group.Path == this.adminGroupPath || group.Path == this.supportGroupPath {
+				changedOrganizations = nil
+				return
+			}
+			if changedOrganizations != nil {
+				changedOrganizations[group.GetOrganizationName()] = true
+			}
+		}
+	}
+
+	groupsByUserId := make(map[string][]*KeycloakGroup)
+	for _, user := range users {
+		if groups, ok := this.groupsByUserId[user.Id]; ok {
+			groupsByUserId[user.Id] = groups
+		}
+	}
+	for keycloakUser, groups := range keycloakUserGroups {
+		if !fullSync {
+			addChangedOrganizations(this.groupsByUserId[keycloakUser.Id])
+			addChangedOrganizations(groups)
+		}
+		groupsByUserId[keycloakUser.Id] = groups
+	}
+	// users deleted in Keycloak are gone from usersById, only their cached groups tell which organizations they were in
+	if !fullSync {
+		for userId, groups := range this.groupsByUserId {
+			if _, ok := groupsByUserId[userId]; !ok {
+				addChangedOrganizations(groups)
+			}
+		}
+	}
+
+	snapshot := &IdentitySnapshot{
+		Users:       users,
+		Memberships: make(map[*User][]*Membership),
+	}
+	if !fullSync {
+		snapshot.ChangedOrganizations = changedOrganizations
+	}
+	organizations := make(map[string]*Organization)
+	organizationGroupsByName := make(map[string]*KeycloakGroup)
+	for _, organizationGroup := range organizationGroups {
+		organizationGroupsByName[organizationGroup.Name] = organizationGroup
+		organization := &Organization{
+			Name:        organizationGroup.Name,
+			DisplayName: organizationGroup.GetDisplayNameAttribute(),
+		}
+		// the subgroups have been fetched during the last full sync, if they aren't inlined anyway
+		teamGroups, err := this.getChildGroups(organizationGroup)
+		if err != nil {
+			return nil, err
+		}
+		for _, teamGroup := range teamGroups {
+			team := &Team{
+				Name:        teamGroup.Name,
+				DisplayName: teamGroup.GetDisplayNameAttribute(),
+			}
+			for _, value := range teamGroup.GetAttributeValues(this.folderAttribute) {
+				folderPermission := parseFolderPermission(value)
+				if folderPermission == nil {
+					continue
+				}
+				team.FolderPermissions = append(team.FolderPermissions, folderPermission)
+			}
+			organization.Teams = append(organization.Teams, team)
+		}
+		organizations[organization.Name] = organization
+		snapshot.Organizations = append(snapshot.Organizations, organization)
+	}
+
+	for _, user := range users {
+		isAdmin := false
+		isServerAdmin := false
+		isSupportUser := false
+		isAutoAssignOrgMember := false
+		for _, group := range groupsByUserId[user.Id] {
+			if group.Path == this.adminGroupPath {
+				isAdmin = true
+			}
+			if group.Path == this.serverAdminGroupPath {
+				isServerAdmin = true
+			}
+			if group.Path == this.supportGroupPath {
+				isSupportUser = true
+			}
+			if group.Path == this.autoAssignOrgGroupPath {
+				isAutoAssignOrgMember = true
+			}
+			pathElements := group.GetPathElements()
+			if len(pathElements) < 2 || pathElements[0] != "organizations" {
+				continue
+			}
+			if organization, ok := organizations[pathElements[1]]; ok {
+				team := ""
+				if len(pathElements) > 2 {
+					team = pathElements[2]
+				}
+				// team members get the role of the team group, or the one of the organization group if the team doesn't define one
+				role := this.getRoleAttribute(group)
+				if role == "" {
+					role = this.getRoleAttribute(organizationGroupsByName[organization.Name])
+				}
+				expires := this.getMembershipExpiry(group, organizationGroupsByName[organization.Name])
+				snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization, Team: team, Role: role, Expires: expires})
+			}
+		}
+		if isAdmin {
+			snapshot.Admins = append(snapshot.Admins, user)
+		}
+		if isServerAdmin {
+			snapshot.ServerAdmins = append(snapshot.ServerAdmins, user)
+		}
+		if isSupportUser {
+			snapshot.SupportUsers = append(snapshot.SupportUsers, user)
+		}
+		if isAutoAssignOrgMember {
+			snapshot.AutoAssignOrgMembers = append(snapshot.AutoAssignOrgMembers, user)
+		}
+	}
+
+	this.groupsByUserId = groupsByUserId
+	this.organizationGroups = organizationGroups
+	this.changedUserIds = make(map[string]bool)
+	this.fullSyncPending = false
+
+	return snapshot, nil
+}
+
+func (this *KeycloakClient) getRoleAttribute(group *KeycloakGroup) string {
+	if group == nil {
+		return ""
+	}
+	value := group.GetAttribute(this.roleAttribute)
+	if value == "" {
+		return ""
+	}
+	role := normalizeRole(value)
+	if role == "" && !this.invalidAttributeWarned[group.Path+"\x00"+value] {
+		this.invalidAttributeWarned[group.Path+"\x00"+value] = true
+		klog.Warningf("Group '%s' has invalid role '%s' in attribute '%s', ignoring", group.Path, value, this.roleAttribute)
+	}
+	return role
+}
+
+// Team members are subject to the expiry of the organization group as well, the earlier expiry applies
+func (this *KeycloakClient) getMembershipExpiry(group *KeycloakGroup, organizationGroup *KeycloakGroup) time.Time {
+	expires := this.getExpiresAttribute(group)
+	organizationExpires := this.getExpiresAttribute(organizationGroup)
+	if expires.IsZero() || (!organizationExpires.IsZero() && organizationExpires.Before(expires)) {
+		return organizationExpires
+	}
+	return expires
+}
+
+// Membership in groups with an expiry only grants temporary access. Invalid values deny access, as the group is obviously meant to be temporary.
+func (this *KeycloakClient) getExpiresAttribute(group *KeycloakGroup) time.Time {
+	if group == nil {
+		return time.Time{}
+	}
+	value := group.GetAttribute(this.expiresAttribute)
+	if value == "" {
+		return time.Time{}
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if !this.invalidAttributeWarned[group.Path+"\x00"+value] {
+			this.invalidAttributeWarned[group.Path+"\x00"+value] = true
+			klog.Warningf("Group '%s' has invalid expiry '%s' in attribute '%s', denying access: %v", group.Path, value, this.expiresAttribute, err)
+		}
+		return time.Unix(0, 0)
+	}
+	return expires
+}
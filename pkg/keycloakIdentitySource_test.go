@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetMembershipExpiry(t *testing.T) {
+	client := &KeycloakClient{expiresAttribute: "grafanaExpires", invalidAttributeWarned: make(map[string]bool)}
+	newGroup := func(path string, expires string) *KeycloakGroup {
+		attributes := make(map[string][]string)
+		if expires != "" {
+			attributes["grafanaExpires"] = []string{expires}
+		}
+		return &KeycloakGroup{Path: path, Attributes: &attributes}
+	}
+	earlier := "2026-01-01T00:00:00Z"
+	later := "2026-06-01T00:00:00Z"
+
+	tests := []struct {
+		name              string
+		teamExpires       string
+		organizationGroup *KeycloakGroup
+		expected          string
+	}{
+		{"no expiry", "", newGroup("/organizations/acme", ""), ""},
+		{"team expiry only", earlier, newGroup("/organizations/acme", ""), earlier},
+		{"organization expiry only", "", newGroup("/organizations/acme", earlier), earlier},
+		{"organization expires first", later, newGroup("/organizations/acme", earlier), earlier},
+		{"team expires first", earlier, newGroup("/organizations/acme", later), earlier},
+		{"invalid organization expiry", later, newGroup("/organizations/acme", "tomorrow"), "1970-01-01T00:00:00Z"},
+		{"organization group unknown", earlier, nil, earlier},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expires := client.getMembershipExpiry(newGroup("/organizations/acme/ops", test.teamExpires), test.organizationGroup)
+			if test.expected == "" {
+				if !expires.IsZero() {
+					t.Errorf("Expected no expiry, got %s", expires)
+				}
+				return
+			}
+			expected, _ := time.Parse(time.RFC3339, test.expected)
+			if !expires.Equal(expected) {
+				t.Errorf("Expected expiry %s, got %s", expected, expires)
+			}
+		})
+	}
+}
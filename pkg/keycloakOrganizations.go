@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"k8s.io/klog/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Organization as returned by the Organizations API of Keycloak 25+
+type KeycloakOrganization struct {
+	Id          string               `json:"id"`
+	Name        string               `json:"name"`
+	Alias       string               `json:"alias"`
+	Enabled     *bool                `json:"enabled"` // nil if Keycloak doesn't return it, which counts as enabled
+	Description string               `json:"description"`
+	Attributes  *map[string][]string `json:"attributes"`
+}
+
+// The alias is the URL-safe identifier of the organization, the name is meant for humans. Older Keycloak versions don't have the alias.
+func (this *KeycloakOrganization) GetIdentifier() string {
+	if this.Alias != "" {
+		return this.Alias
+	}
+	return this.Name
+}
+
+// Represent the organization the same way as organization groups are represented, so that the rest of the operator doesn't need to care where organizations come from
+func (this *KeycloakOrganization) toGroup() *KeycloakGroup {
+	attributes := make(map[string][]string)
+	if this.Attributes != nil {
+		for k, v := range *this.Attributes {
+			attributes[k] = v
+		}
+	}
+	if _, ok := attributes["displayName"]; !ok && this.Name != this.GetIdentifier() {
+		attributes["displayName"] = []string{this.Name}
+	}
+	return &KeycloakGroup{
+		Id:         this.Id,
+		Name:       this.GetIdentifier(),
+		Path:       "/organizations/" + this.GetIdentifier(),
+		Attributes: &attributes,
+	}
+}
+
+func (this *KeycloakClient) GetApiOrganizations() ([]*KeycloakOrganization, error) {
+	organizations := make([]*KeycloakOrganization, 0)
+	for first := 0; ; first += keycloakPageSize {
+		page := make([]*KeycloakOrganization, 0)
+		err := this.getJsonPage("organizations?briefRepresentation=false", first, &page)
+		if err != nil {
+			return nil, err
+		}
+		// disabled organizations are treated as if they didn't exist, so they are removed from Grafana
+		for _, organization := range page {
+			if organization.Enabled == nil || *organization.Enabled {
+				organizations = append(organizations, organization)
+			}
+		}
+		if len(page) < keycloakPageSize {
+			return organizations, nil
+		}
+	}
+}
+
+func (this *KeycloakClient) getApiOrganizationMembers(organization *KeycloakOrganization) ([]*KeycloakUser, error) {
+	members := make([]*KeycloakUser, 0)
+	for first := 0; ; first += keycloakPageSize {
+		page := make([]*KeycloakUser, 0)
+		err := this.getJsonPage(fmt.Sprintf("organizations/%s/members", organization.Id), first, &page)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(page) < keycloakPageSize {
+			return members, nil
+		}
+	}
+}
+
+func (this *KeycloakClient) getApiOrganizationGroups() ([]*KeycloakGroup, error) {
+	if this.apiOrganizations == nil {
+		err := this.fetchApiOrganizations()
+		if err != nil {
+			return nil, err
+		}
+	}
+	groups := make([]*KeycloakGroup, 0, len(this.apiOrganizations))
+	for _, organization := range this.apiOrganizations {
+		groups = append(groups, organization.toGroup())
+	}
+	return groups, nil
+}
+
+func (this *KeycloakClient) organizationMembersWorker(organizationChan chan *KeycloakOrganization, results *sync.Map, errorCount *uint64, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for organization := range organizationChan {
+		members, err := this.getApiOrganizationMembers(organization)
+		if err != nil {
+			atomic.AddUint64(errorCount, 1)
+			klog.Error(err)
+		}
+		results.Store(organization, members)
+	}
+}
+
+// Fetch the organizations and their members. This is only needed for full syncs, in between the cached members are used, as
+// changes to organizations and their members always trigger a full sync, see keycloakEvents.go.
+func (this *KeycloakClient) fetchApiOrganizations() error {
+	organizations, err := this.GetApiOrganizations()
+	if err != nil {
+		return err
+	}
+
+	results := sync.Map{}
+	var errorCount uint64
+
+	organizationChan := make(chan *KeycloakOrganization)
+	wg := new(sync.WaitGroup)
+
+	// creating workers
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go this.organizationMembersWorker(organizationChan, &results, &errorCount, wg)
+	}
+
+	// sending organizations to workers
+	for _, organization := range organizations {
+		organizationChan <- organization
+	}
+
+	close(organizationChan)
+	wg.Wait()
+
+	if errorCount > 0 {
+		return errors.New("Could not fetch all organization members")
+	}
+
+	organizationGroupsByUserId := make(map[string][]*KeycloakGroup)
+	results.Range(func(k, v interface{}) bool {
+		organizationGroup := k.(*KeycloakOrganization).toGroup()
+		for _, member := range v.([]*KeycloakUser) {
+			organizationGroupsByUserId[member.Id] = append(organizationGroupsByUserId[member.Id], organizationGroup)
+		}
+		return true
+	})
+
+	this.apiOrganizations = organizations
+	this.apiOrganizationGroupsByUserId = organizationGroupsByUserId
+	return nil
+}
+
+// Add the memberships of the Keycloak organizations to the group memberships of the users.
+// Organization membership is defined by the Organizations API only, groups below "/organizations" are dropped.
+// The members are taken from the last call to fetchApiOrganizations().
+func (this *KeycloakClient) addApiOrganizationMemberships(userGroups map[*KeycloakUser][]*KeycloakGroup) error {
+	if this.apiOrganizationGroupsByUserId == nil {
+		err := this.fetchApiOrganizations()
+		if err != nil {
+			return err
+		}
+	}
+
+	for user, groups := range userGroups {
+		var filteredGroups []*KeycloakGroup
+		for _, group := range groups {
+			if !strings.HasPrefix(group.Path, "/organizations/") {
+				filteredGroups = append(filteredGroups, group)
+			}
+		}
+		userGroups[user] = append(filteredGroups, this.apiOrganizationGroupsByUserId[user.Id]...)
+	}
+
+	return nil
+}
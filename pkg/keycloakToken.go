@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are renewed this long before they actually expire, so that a token doesn't expire while a request is in flight
+const keycloakTokenExpiryMargin = 30 * time.Second
+
+// The token currently held by the KeycloakClient. Access is synchronized because the workers fetching users and groups share it.
+type keycloakToken struct {
+	lock               sync.Mutex
+	accessToken        string
+	accessTokenExpiry  time.Time
+	refreshToken       string
+	refreshTokenExpiry time.Time
+}
+
+type keycloakTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Returns a valid access token. The cached token is used as long as it is valid, then it is refreshed using the refresh token.
+// If that's not possible (e.g. because the client credentials grant doesn't issue refresh tokens) a new token is requested.
+func (this *KeycloakClient) getAccessToken() (string, error) {
+	this.token.lock.Lock()
+	defer this.token.lock.Unlock()
+
+	now := time.Now()
+	if this.token.accessToken != "" && now.Before(this.token.accessTokenExpiry) {
+		return this.token.accessToken, nil
+	}
+
+	if this.token.refreshToken != "" && (this.token.refreshTokenExpiry.IsZero() || now.Before(this.token.refreshTokenExpiry)) {
+		data := url.Values{}
+		data.Set("grant_type", "refresh_token")
+		data.Set("refresh_token", this.token.refreshToken)
+		err := this.requestToken(data)
+		if err == nil {
+			return this.token.accessToken, nil
+		}
+		klog.Warningf("Could not refresh Keycloak token, requesting a new one: %v", err)
+		this.token.refreshToken = ""
+	}
+
+	data := url.Values{}
+	if this.username != "" {
+		data.Set("grant_type", "password")
+		data.Set("username", this.username)
+		data.Set("password", this.password)
+	} else {
+		data.Set("grant_type", "client_credentials")
+	}
+	err := this.requestToken(data)
+	if err != nil {
+		return "", err
+	}
+	return this.token.accessToken, nil
+}
+
+// Forget the access token so the next call to getAccessToken() refreshes it. Does nothing if the token has already been replaced.
+func (this *KeycloakClient) invalidateAccessToken(accessToken string) {
+	this.token.lock.Lock()
+	defer this.token.lock.Unlock()
+
+	if this.token.accessToken == accessToken {
+		this.token.accessToken = ""
+	}
+}
+
+// Call the token endpoint with the given grant and store the result. The caller must hold the token lock.
+// The grant type is chosen by the caller, the client authentication is added here, see KeycloakConfig.
+func (this *KeycloakClient) requestToken(data url.Values) error {
+	tokenUrl, err := this.realmUrl("protocol/openid-connect/token")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", tokenUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header["Accept"] = []string{"application/json"}
+	req.Header["Content-Type"] = []string{"application/x-www-form-urlencoded"}
+	req.Header["cache-control"] = []string{"no-cache"}
+
+	data.Set("client_id", this.clientId)
+	if this.clientAssertionKey != nil {
+		assertion, err := this.clientAssertionKey.sign(this.clientId, tokenUrl)
+		if err != nil {
+			return err
+		}
+		data.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		data.Set("client_assertion", assertion)
+	} else if this.clientSecret != "" {
+		data.Set("client_secret", this.clientSecret)
+	}
+	req.Body = io.NopCloser(strings.NewReader(data.Encode()))
+
+	requested := time.Now()
+	r, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	var tokenResponse keycloakTokenResponse
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return fmt.Errorf("Could not parse Keycloak token response (%s): %w", r.Status, err)
+	}
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not get Keycloak token (%s): %s %s", r.Status, tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.AccessToken == "" {
+		return errors.New("access_token not found in JSON response")
+	}
+
+	this.token.accessToken = tokenResponse.AccessToken
+	this.token.accessTokenExpiry = tokenExpiry(requested, tokenResponse.ExpiresIn)
+	this.token.refreshToken = tokenResponse.RefreshToken
+	this.token.refreshTokenExpiry = time.Time{} // offline tokens don't expire
+	if tokenResponse.RefreshExpiresIn > 0 {
+		this.token.refreshTokenExpiry = tokenExpiry(requested, tokenResponse.RefreshExpiresIn)
+	}
+	return nil
+}
+
+// The time at which a token valid for expiresIn seconds should be renewed. The margin is capped at half the lifetime, otherwise
+// short-lived tokens would look expired right away and be requested again on every call.
+func tokenExpiry(requested time.Time, expiresIn int64) time.Time {
+	lifetime := time.Duration(expiresIn) * time.Second
+	margin := keycloakTokenExpiryMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return requested.Add(lifetime - margin)
+}
+
+// Send a request with the current access token. If Keycloak rejects the token the request is retried once with a fresh token.
+// Only use this for requests without body, as the request is sent a second time on retry.
+func (this *KeycloakClient) doAuthenticated(req *http.Request) (*http.Response, error) {
+	accessToken, err := this.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Authorization"] = []string{"Bearer " + accessToken}
+
+	r, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != http.StatusUnauthorized {
+		return r, nil
+	}
+	r.Body.Close()
+
+	klog.Infof("Keycloak rejected access token, retrying with new token")
+	this.invalidateAccessToken(accessToken)
+	accessToken, err = this.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Authorization"] = []string{"Bearer " + accessToken}
+	return this.client.Do(req)
+}
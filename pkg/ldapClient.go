@@ -0,0 +1,303 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"k8s.io/klog/v2"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Settings of the LDAP identity source. Empty attributes and filters are set to defaults by NewLdapClient().
+//
+// Organizations are either groups (OrganizationMode "group") whose members are listed in MemberAttribute
+// ("member" for groupOfNames and "uniqueMember" for groupOfUniqueNames if not set),
+// or organizational units (OrganizationMode "ou") whose members are the users located below the unit.
+// In "ou" mode users in a unit below the organization unit are considered to be in the team named after that unit.
+// In both modes only entries directly below OrganizationBaseDn are organizations.
+type LdapConfig struct {
+	Url                              string
+	StartTLS                         bool
+	BindDn                           string
+	BindPassword                     string
+	UserBaseDn                       string
+	UserFilter                       string
+	UsernameAttribute                string
+	IdAttribute                      string
+	OrganizationMode                 string
+	OrganizationBaseDn               string
+	OrganizationFilter               string
+	OrganizationNameAttribute        string
+	OrganizationDisplayNameAttribute string
+	MemberAttribute                  string
+	AdminGroupDn                     string
+}
+
+type LdapClient struct {
+	config           LdapConfig
+	memberAttributes []string
+	dnsByUsername    map[string]string // DNs of the users returned by the last call to GetUsers(), as returned by the server
+}
+
+const ldapPageSize = 500
+
+func NewLdapClient(config LdapConfig) (*LdapClient, error) {
+	if config.Url == "" {
+		return nil, errors.New("LDAP URL missing")
+	}
+	if config.UserBaseDn == "" || config.OrganizationBaseDn == "" {
+		return nil, errors.New("LDAP user base DN and organization base DN are required")
+	}
+
+	if config.UserFilter == "" {
+		config.UserFilter = "(objectClass=inetOrgPerson)"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.IdAttribute == "" {
+		config.IdAttribute = "entryUUID"
+	}
+	memberAttributes := []string{"member", "uniqueMember"}
+	if config.MemberAttribute != "" {
+		memberAttributes = []string{config.MemberAttribute}
+	}
+	if config.OrganizationDisplayNameAttribute == "" {
+		config.OrganizationDisplayNameAttribute = "description"
+	}
+	switch config.OrganizationMode {
+	case "", "group":
+		config.OrganizationMode = "group"
+		if config.OrganizationFilter == "" {
+			config.OrganizationFilter = "(|(objectClass=groupOfNames)(objectClass=groupOfUniqueNames))"
+		}
+		if config.OrganizationNameAttribute == "" {
+			config.OrganizationNameAttribute = "cn"
+		}
+	case "ou":
+		if config.OrganizationFilter == "" {
+			config.OrganizationFilter = "(objectClass=organizationalUnit)"
+		}
+		if config.OrganizationNameAttribute == "" {
+			config.OrganizationNameAttribute = "ou"
+		}
+	default:
+		return nil, fmt.Errorf("Unknown LDAP organization mode '%s', must be 'group' or 'ou'", config.OrganizationMode)
+	}
+
+	return &LdapClient{config: config, memberAttributes: memberAttributes}, nil
+}
+
+// A new connection is used for every reconciliation, there's no point in keeping connections open for minutes
+func (this *LdapClient) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(this.config.Url)
+	if err != nil {
+		return nil, err
+	}
+	if this.config.StartTLS {
+		// the server certificate is verified against the host of the URL
+		u, err := url.Parse(this.config.Url)
+		if err == nil {
+			err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if this.config.BindDn != "" {
+		err = conn.Bind(this.config.BindDn, this.config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (this *LdapClient) search(conn *ldap.Conn, baseDn string, scope int, filter string, attributes []string) ([]*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(baseDn, scope, ldap.NeverDerefAliases, 0, 0, false, filter, attributes, nil)
+	result, err := conn.SearchWithPaging(searchRequest, ldapPageSize)
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+// DNs are compared case-insensitively and without spaces between the RDNs
+func normalizeDn(dn string) string {
+	parsedDn, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	rdns := make([]string, 0, len(parsedDn.RDNs))
+	for _, rdn := range parsedDn.RDNs {
+		attributes := make([]string, 0, len(rdn.Attributes))
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// Values of uniqueMember may have an optional UID appended, e.g. "uid=jane,ou=users,dc=example,dc=com#'0101'B"
+var ldapUniqueMemberUidSuffix = regexp.MustCompile(`#'[01]*'B$`)
+
+// DNs of the members of a group, which are listed in one of the member attributes
+func (this *LdapClient) getMemberDns(entry *ldap.Entry) []string {
+	var memberDns []string
+	for _, attribute := range this.memberAttributes {
+		for _, memberDn := range entry.GetEqualFoldAttributeValues(attribute) {
+			memberDns = append(memberDns, ldapUniqueMemberUidSuffix.ReplaceAllString(memberDn, ""))
+		}
+	}
+	return memberDns
+}
+
+// The ID of a user. Binary IDs like the objectGUID of Active Directory are hex encoded, the raw bytes wouldn't survive
+// the JSON round trip through the user state file.
+func (this *LdapClient) getId(entry *ldap.Entry) string {
+	id := entry.GetRawAttributeValue(this.config.IdAttribute)
+	if len(id) == 0 {
+		return normalizeDn(entry.DN)
+	}
+	if !utf8.Valid(id) {
+		return hex.EncodeToString(id)
+	}
+	return string(id)
+}
+
+// In "ou" mode the unit directly below the organization unit is the team of the user, if there is one
+func (this *LdapClient) getTeam(user *User, organizationDn string) string {
+	parsedUserDn, err := ldap.ParseDN(this.dnsByUsername[user.Username])
+	if err != nil {
+		return ""
+	}
+	parsedOrganizationDn, err := ldap.ParseDN(organizationDn)
+	if err != nil {
+		return ""
+	}
+	// RDNs are ordered from the leaf to the root
+	teamIndex := len(parsedUserDn.RDNs) - len(parsedOrganizationDn.RDNs) - 1
+	if teamIndex < 1 || len(parsedUserDn.RDNs[teamIndex].Attributes) == 0 {
+		return ""
+	}
+	return parsedUserDn.RDNs[teamIndex].Attributes[0].Value
+}
+
+// LdapClient implements IdentitySource
+
+func (this *LdapClient) GetUsers(ctx context.Context) ([]*User, error) {
+	conn, err := this.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entries, err := this.search(conn, this.config.UserBaseDn, ldap.ScopeWholeSubtree, this.config.UserFilter, []string{this.config.UsernameAttribute, this.config.IdAttribute, "mail", "givenName", "sn"})
+	if err != nil {
+		return nil, err
+	}
+
+	this.dnsByUsername = make(map[string]string)
+	users := make([]*User, 0, len(entries))
+	for _, entry := range entries {
+		username := entry.GetAttributeValue(this.config.UsernameAttribute)
+		if username == "" {
+			klog.Warningf("LDAP user '%s' has no attribute '%s', ignoring", entry.DN, this.config.UsernameAttribute)
+			continue
+		}
+		this.dnsByUsername[username] = entry.DN
+		users = append(users, &User{
+			Id:        this.getId(entry),
+			Username:  username,
+			Email:     entry.GetAttributeValue("mail"),
+			FirstName: entry.GetAttributeValue("givenName"),
+			LastName:  entry.GetAttributeValue("sn"),
+		})
+	}
+	return users, nil
+}
+
+func (this *LdapClient) GetSnapshot(ctx context.Context, users []*User) (*IdentitySnapshot, error) {
+	conn, err := this.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	klog.Infof("Fetching organizations from LDAP...")
+	entries, err := this.search(conn, this.config.OrganizationBaseDn, ldap.ScopeSingleLevel, this.config.OrganizationFilter, append([]string{this.config.OrganizationNameAttribute, this.config.OrganizationDisplayNameAttribute}, this.memberAttributes...))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &IdentitySnapshot{
+		Users:       users,
+		Memberships: make(map[*User][]*Membership),
+	}
+
+	usersByDn := make(map[string]*User)
+	for _, user := range users {
+		if dn, ok := this.dnsByUsername[user.Username]; ok {
+			usersByDn[normalizeDn(dn)] = user
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.GetAttributeValue(this.config.OrganizationNameAttribute)
+		if name == "" {
+			continue
+		}
+		organization := &Organization{
+			Name:        name,
+			DisplayName: entry.GetAttributeValue(this.config.OrganizationDisplayNameAttribute),
+		}
+		snapshot.Organizations = append(snapshot.Organizations, organization)
+
+		if this.config.OrganizationMode == "ou" {
+			organizationDn := normalizeDn(entry.DN)
+			for dn, user := range usersByDn {
+				if !strings.HasSuffix(dn, ","+organizationDn) {
+					continue
+				}
+				snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization, Team: this.getTeam(user, entry.DN)})
+			}
+		} else {
+			for _, memberDn := range this.getMemberDns(entry) {
+				if user, ok := usersByDn[normalizeDn(memberDn)]; ok {
+					snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization})
+				}
+			}
+		}
+	}
+
+	if this.config.AdminGroupDn != "" {
+		klog.Infof("Fetching admin group from LDAP...")
+		adminEntries, err := this.search(conn, this.config.AdminGroupDn, ldap.ScopeBaseObject, "(objectClass=*)", this.memberAttributes)
+		if err != nil {
+			return nil, err
+		}
+		for _, adminEntry := range adminEntries {
+			for _, memberDn := range this.getMemberDns(adminEntry) {
+				if user, ok := usersByDn[normalizeDn(memberDn)]; ok {
+					snapshot.Admins = append(snapshot.Admins, user)
+				}
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (this *LdapClient) CloseIdleConnections() {
+}
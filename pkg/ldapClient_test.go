@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testLdapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+var testLdapDirectory = []testLdapEntry{
+	{"uid=alice,ou=users,dc=example,dc=com", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"alice"}, "entryUUID": {"id-alice"}, "mail": {"alice@example.com"}, "givenName": {"Alice"}, "sn": {"Smith"}}},
+	{"uid=bob,ou=users,dc=example,dc=com", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"bob"}, "entryUUID": {"id-bob"}, "mail": {"bob@example.com"}}},
+	{"uid=carol,ou=users,dc=example,dc=com", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"carol"}}},
+	{"uid=dave,ou=users,dc=example,dc=com", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"dave"}, "entryUUID": {"\xde\xad\xbe\xef"}}},
+	{"cn=acme,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"acme"}, "description": {"ACME Corp"}, "member": {"uid=alice,ou=users,dc=example,dc=com", "UID=Bob, OU=Users, DC=example, DC=com"}}},
+	{"cn=globex,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"groupOfUniqueNames"}, "cn": {"globex"}, "uniqueMember": {"uid=bob,ou=users,dc=example,dc=com#'0101'B"}}},
+	{"cn=other,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"device"}, "cn": {"other"}}},
+	{"cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"admins"}, "member": {"uid=carol,ou=users,dc=example,dc=com"}}},
+}
+
+// Minimal in-process LDAP server supporting binds and searches with equality, presence, and, or and not filters
+func startTestLdapServer(t *testing.T, directory []testLdapEntry) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestLdapConnection(conn, directory)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func serveTestLdapConnection(conn net.Conn, directory []testLdapEntry) {
+	defer conn.Close()
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		messageId := request.Children[0].Value.(int64)
+		operation := request.Children[1]
+		switch operation.Tag {
+		case ldap.ApplicationBindRequest:
+			conn.Write(newTestLdapResponse(messageId, ldap.ApplicationBindResponse).Bytes())
+		case ldap.ApplicationSearchRequest:
+			baseDn := normalizeDn(operation.Children[0].Data.String())
+			scope := int(operation.Children[1].Value.(int64))
+			for _, entry := range directory {
+				if !testLdapInScope(normalizeDn(entry.dn), baseDn, scope) || !testLdapMatches(entry, operation.Children[6]) {
+					continue
+				}
+				conn.Write(newTestLdapSearchResultEntry(messageId, entry, operation.Children[7]).Bytes())
+			}
+			conn.Write(newTestLdapResponse(messageId, ldap.ApplicationSearchResultDone).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func newTestLdapResponse(messageId int64, application ber.Tag) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(ldap.LDAPResultSuccess), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	envelope.AppendChild(response)
+	return envelope
+}
+
+func newTestLdapSearchResultEntry(messageId int64, entry testLdapEntry, requestedAttributes *ber.Packet) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, requestedAttribute := range requestedAttributes.Children {
+		name := requestedAttribute.Data.String()
+		values := testLdapAttributeValues(entry, name)
+		if len(values) == 0 {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	result.AppendChild(attributes)
+	envelope.AppendChild(result)
+	return envelope
+}
+
+func testLdapAttributeValues(entry testLdapEntry, name string) []string {
+	for attributeName, values := range entry.attributes {
+		if strings.EqualFold(attributeName, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func testLdapInScope(dn string, baseDn string, scope int) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == baseDn
+	case ldap.ScopeSingleLevel:
+		parent := dn[strings.Index(dn, ",")+1:]
+		return strings.Contains(dn, ",") && parent == baseDn
+	default:
+		return dn == baseDn || strings.HasSuffix(dn, ","+baseDn)
+	}
+}
+
+func testLdapMatches(entry testLdapEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !testLdapMatches(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if testLdapMatches(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !testLdapMatches(entry, filter.Children[0])
+	case ldap.FilterPresent:
+		return len(testLdapAttributeValues(entry, filter.Data.String())) > 0
+	case ldap.FilterEqualityMatch:
+		for _, value := range testLdapAttributeValues(entry, filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func getTestMemberships(snapshot *IdentitySnapshot) []string {
+	var memberships []string
+	for user, userMemberships := range snapshot.Memberships {
+		for _, membership := range userMemberships {
+			memberships = append(memberships, user.Username+"@"+membership.Organization.Name+"/"+membership.Team)
+		}
+	}
+	sort.Strings(memberships)
+	return memberships
+}
+
+func TestLdapClientGroupMode(t *testing.T) {
+	client, err := NewLdapClient(LdapConfig{
+		Url:                startTestLdapServer(t, testLdapDirectory),
+		UserBaseDn:         "ou=users,dc=example,dc=com",
+		OrganizationBaseDn: "ou=organizations,dc=example,dc=com",
+		AdminGroupDn:       "cn=admins,ou=groups,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := client.GetUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersByName := make(map[string]*User)
+	for _, user := range users {
+		usersByName[user.Username] = user
+	}
+	if len(users) != 4 {
+		t.Fatalf("Expected 4 users, got %d", len(users))
+	}
+	alice := usersByName["alice"]
+	if alice == nil || alice.Id != "id-alice" || alice.Email != "alice@example.com" || alice.GetDisplayName() != "Alice Smith" {
+		t.Errorf("Unexpected user alice: %+v", alice)
+	}
+	// without entryUUID the normalized DN is the ID
+	if carol := usersByName["carol"]; carol == nil || carol.Id != "uid=carol,ou=users,dc=example,dc=com" {
+		t.Errorf("Unexpected user carol: %+v", carol)
+	}
+	// binary IDs are hex encoded
+	if dave := usersByName["dave"]; dave == nil || dave.Id != "deadbeef" {
+		t.Errorf("Unexpected user dave: %+v", dave)
+	}
+
+	snapshot, err := client.GetSnapshot(context.Background(), users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Organizations) != 2 {
+		t.Fatalf("Expected 2 organizations, got %d", len(snapshot.Organizations))
+	}
+	for _, organization := range snapshot.Organizations {
+		if organization.Name == "acme" && organization.GetDisplayName() != "ACME Corp" {
+			t.Errorf("Unexpected display name of acme: '%s'", organization.GetDisplayName())
+		}
+	}
+	expectedMemberships := []string{"alice@acme/", "bob@acme/", "bob@globex/"}
+	if memberships := getTestMemberships(snapshot); strings.Join(memberships, " ") != strings.Join(expectedMemberships, " ") {
+		t.Errorf("Expected memberships %v, got %v", expectedMemberships, memberships)
+	}
+	if len(snapshot.Admins) != 1 || snapshot.Admins[0].Username != "carol" {
+		t.Errorf("Expected carol to be the only admin, got %v", snapshot.Admins)
+	}
+}
+
+func TestLdapClientOuMode(t *testing.T) {
+	directory := []testLdapEntry{
+		{"ou=acme,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"acme"}}},
+		{"uid=alice,ou=acme,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"alice"}}},
+		{"ou=ops,ou=acme,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"ops"}}},
+		{"uid=bob,ou=ops,ou=acme,ou=organizations,dc=example,dc=com", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"bob"}}},
+	}
+	client, err := NewLdapClient(LdapConfig{
+		Url:                startTestLdapServer(t, directory),
+		UserBaseDn:         "ou=organizations,dc=example,dc=com",
+		OrganizationMode:   "ou",
+		OrganizationBaseDn: "ou=organizations,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := client.GetUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := client.GetSnapshot(context.Background(), users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Organizations) != 1 || snapshot.Organizations[0].Name != "acme" {
+		t.Fatalf("Expected organization acme only, got %v", snapshot.Organizations)
+	}
+	expectedMemberships := []string{"alice@acme/", "bob@acme/ops"}
+	if memberships := getTestMemberships(snapshot); strings.Join(memberships, " ") != strings.Join(expectedMemberships, " ") {
+		t.Errorf("Expected memberships %v, got %v", expectedMemberships, memberships)
+	}
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"fmt"
+	grafana "github.com/grafana/grafana-api-golang-client"
+	"regexp"
+	"strings"
+)
+
+// Grafana only returns human readable labels of the auth modules a user has logged in with, these are the labels of the auth modules
+var grafanaAuthModuleLabels = map[string]string{
+	"ldap":                "LDAP",
+	"auth.saml":           "SAML",
+	"saml":                "SAML",
+	"auth.jwt":            "JWT",
+	"jwt":                 "JWT",
+	"auth.proxy":          "Auth Proxy",
+	"authproxy":           "Auth Proxy",
+	"oauth_generic_oauth": "Generic OAuth",
+	"oauth_github":        "GitHub",
+	"oauth_gitlab":        "GitLab",
+	"oauth_google":        "Google",
+	"oauth_azuread":       "AzureAD",
+	"oauth_okta":          "Okta",
+	"oauth_grafana_com":   "grafana.com",
+	"oauth_grafananet":    "grafana.com",
+}
+
+// Returns true if the user has logged in with the given auth module. The module is either the ID used in the Grafana
+// configuration (e.g. "oauth_generic_oauth"), the label shown by Grafana (e.g. "Generic OAuth") or "local" for users without auth module.
+func hasAuthModule(user grafana.UserSearch, module string) bool {
+	if module == "local" {
+		return len(user.AuthLabels) == 0
+	}
+	label, ok := grafanaAuthModuleLabels[module]
+	if !ok {
+		label = module
+	}
+	for _, authLabel := range user.AuthLabels {
+		if strings.EqualFold(authLabel, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// Users the operator never deletes, never updates and never removes from organizations.
+// "admin" and the user of the operator are always protected.
+type ProtectedUsers struct {
+	Logins             []string
+	Patterns           []*regexp.Regexp // must match the whole login
+	AuthModules        []string         // see hasAuthModule()
+	ManagedAuthModules []string         // if set, all users who didn't log in with one of these auth modules are protected
+}
+
+// Parses comma-separated lists of logins, regular expressions and auth modules
+func ParseProtectedUsers(logins string, patterns string, authModules string, managedAuthModules string) (ProtectedUsers, error) {
+	protectedUsers := ProtectedUsers{
+		Logins:             splitList(logins),
+		AuthModules:        splitList(authModules),
+		ManagedAuthModules: splitList(managedAuthModules),
+	}
+	for _, pattern := range splitList(patterns) {
+		compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return protectedUsers, fmt.Errorf("Invalid protected user pattern '%s': %v", pattern, err)
+		}
+		protectedUsers.Patterns = append(protectedUsers.Patterns, compiled)
+	}
+	return protectedUsers, nil
+}
+
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Users created by the operator (see provisionUsers()) haven't logged in with any auth module yet, so only their login is checked
+func (this *ProtectedUsers) isProtected(user grafana.UserSearch, provisioned bool) bool {
+	for _, login := range this.Logins {
+		if user.Login == login {
+			return true
+		}
+	}
+	for _, pattern := range this.Patterns {
+		if pattern.MatchString(user.Login) {
+			return true
+		}
+	}
+	if provisioned {
+		return false
+	}
+	for _, module := range this.AuthModules {
+		if hasAuthModule(user, module) {
+			return true
+		}
+	}
+	if len(this.ManagedAuthModules) == 0 {
+		return false
+	}
+	for _, module := range this.ManagedAuthModules {
+		if hasAuthModule(user, module) {
+			return false
+		}
+	}
+	return true
+}
+
+// Logins of all protected users in Grafana
+func getProtectedLogins(config Config, grafanaUsers []grafana.UserSearch, grafanaClient *GrafanaClient) map[string]bool {
+	protectedLogins := map[string]bool{
+		"admin":                     true,
+		grafanaClient.GetUsername(): true,
+	}
+	for _, grafanaUser := range grafanaUsers {
+		if config.ProtectedUsers.isProtected(grafanaUser, config.UserState.isProvisioned(grafanaUser)) {
+			protectedLogins[grafanaUser.Login] = true
+		}
+	}
+	return protectedLogins
+}
@@ -3,79 +3,126 @@ package controller
 import (
 	"context"
 	"errors"
+	"fmt"
 	"k8s.io/klog/v2"
+	"time"
 )
 
 type Config struct {
 	GrafanaDatasourceUrl      string
 	GrafanaDatasourceUsername string
 	GrafanaDatasourcePassword string
-	GrafanaClearAutoAssignOrg bool
+	GrafanaClearAutoAssignOrg bool         // Manage the members of the auto_assign_org_id organization, only the AutoAssignOrgMembers of the snapshot are kept
+	GrafanaAutoAssignOrgRole  string       // Role of the AutoAssignOrgMembers, "Viewer" if empty
+	GrafanaSupportRole        string       // Role of the SupportUsers on all organizations, "Viewer" if empty
+	GrafanaPreProvisionUsers  bool         // Create Grafana users with access to organizations before their first login, requires skip_org_role_sync
+	RoleMapping               *RoleMapping // nil means that all members get "Editor"
+	GrafanaSyncTeams          bool         // Mirror the teams of the organizations into Grafana teams
+	FolderPermissions         *FolderPermissionRules
+	ProtectedUsers            ProtectedUsers
+	AccessGrants              *AccessGrants // Temporary memberships, nil if neither the file nor the identity source grant any
+	UserDeletionGracePeriod   time.Duration // Users missing in the identity source are disabled and only deleted after this time, requires UserState
+	UserState                 *UserState
 }
 
 var (
 	interruptedError = errors.New("interrupted")
 )
 
-func Reconcile(ctx context.Context, config Config, keycloakClient *KeycloakClient, grafanaClient *GrafanaClient, dashboards []Dashboard) error {
-	klog.Infof("Fetching Keycloak access token...")
-	keycloakToken, err := keycloakClient.GetToken()
-	if err != nil {
-		return err
+func Reconcile(ctx context.Context, config Config, identitySource IdentitySource, grafanaClient *GrafanaClient, dashboards []Dashboard) error {
+	if config.GrafanaSupportRole != "" && normalizeRole(config.GrafanaSupportRole) == "" {
+		return fmt.Errorf("Invalid support role: '%s'", config.GrafanaSupportRole)
 	}
 
-	klog.Infof("Fetching users from Keycloak...")
-	keycloakUsers, err := keycloakClient.GetUsers(keycloakToken)
+	klog.Infof("Fetching users...")
+	users, err := identitySource.GetUsers(ctx)
 	if err != nil {
 		return err
 	}
-	klog.Infof("Found %d users", len(keycloakUsers))
+	klog.Infof("Found %d users", len(users))
 
 	klog.Infof("Syncing users to Grafana...")
-	keycloakUsers, err = reconcileUsers(ctx, keycloakUsers, grafanaClient)
+	// fetched once, the steps below keep the list up to date with their changes
+	grafanaUsers, err := grafanaClient.Users()
 	if err != nil {
 		return err
 	}
-	klog.Infof("Synced %d users", len(keycloakUsers))
-
-	klog.Infof("Fetching group memberships from Keycloak...")
-	keycloakUserGroups, err := keycloakClient.GetGroupMemberships(keycloakToken, keycloakUsers)
+	protectedLogins := getProtectedLogins(config, grafanaUsers, grafanaClient)
+	syncedUsers, grafanaUsers, err := reconcileUsers(ctx, config, users, grafanaUsers, protectedLogins, grafanaClient)
 	if err != nil {
 		return err
 	}
-	memberships := 0
-	for _, groups := range keycloakUserGroups {
-		memberships += len(groups)
-	}
-	klog.Infof("Found %d group memberships", memberships)
-
-	klog.Infof("Fetching organizations from Keycloak...")
-	keycloakOrganizations, err := keycloakClient.GetOrganizations(keycloakToken)
-	klog.Infof("Found %d organizations", len(keycloakOrganizations))
-
-	klog.Infof("Extracting admin users...")
-	var keycloakAdmins []*KeycloakUser
-	var keycloakUsersWithoutAdmins []*KeycloakUser
-outAdmins:
-	for _, user := range keycloakUsers {
-		for _, group := range keycloakUserGroups[user] {
-			if group.Path == keycloakClient.adminGroupPath {
-				keycloakAdmins = append(keycloakAdmins, user)
-				continue outAdmins
+	klog.Infof("Synced %d users", len(syncedUsers))
+
+	snapshotUsers := syncedUsers
+	if config.GrafanaPreProvisionUsers {
+		// the memberships of all users are needed to know which users must be created
+		snapshotUsers = make([]*User, 0, len(users))
+		for _, user := range users {
+			if !protectedLogins[user.Username] {
+				snapshotUsers = append(snapshotUsers, user)
 			}
 		}
-		keycloakUsersWithoutAdmins = append(keycloakUsersWithoutAdmins, user)
 	}
-	klog.Infof("Found %d admin users", len(keycloakAdmins))
 
-	grafanaOrgsMap, err := reconcileAllOrgs(ctx, config, keycloakOrganizations, grafanaClient, dashboards)
+	klog.Infof("Fetching organizations and memberships...")
+	snapshot, err := identitySource.GetSnapshot(ctx, snapshotUsers)
+	if err != nil {
+		return err
+	}
+	snapshot.dropInvalidOrganizations()
+	err = config.AccessGrants.apply(snapshot, time.Now())
+	if err != nil {
+		return err
+	}
+	// after the access grants, so that disabled users don't get temporary access either
+	snapshot.dropDisabledUsers()
+	klog.Infof("Found %d organizations, %d memberships, %d admin users, %d support users and %d server admins", len(snapshot.Organizations), snapshot.CountMemberships(), len(snapshot.Admins), len(snapshot.SupportUsers), len(snapshot.ServerAdmins))
+	if snapshot.ChangedOrganizations != nil {
+		klog.Infof("Incremental sync, %d organizations may have changed", len(snapshot.ChangedOrganizations))
+	}
+
+	if config.GrafanaPreProvisionUsers {
+		klog.Infof("Creating missing users...")
+		grafanaUsers, err = provisionUsers(ctx, config, snapshot, syncedUsers, grafanaUsers, grafanaClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("Checking server admins...")
+	err = reconcileServerAdmins(ctx, snapshot, grafanaUsers, protectedLogins, grafanaClient)
+	if err != nil {
+		return err
+	}
+
+	grafanaOrgsMap, err := reconcileAllOrgs(ctx, config, snapshot, grafanaClient, dashboards)
 	if err != nil {
 		return err
 	}
 
 	klog.Infof("Checking permissions of normal orgs...")
-	grafanaPermissionsMap := getGrafanaPermissionsMap(keycloakUserGroups, keycloakAdmins, keycloakOrganizations)
-	err = reconcilePermissions(ctx, grafanaPermissionsMap, grafanaOrgsMap, grafanaClient)
+	grafanaPermissionsMap := getGrafanaPermissionsMap(config, snapshot)
+	for orgName := range grafanaPermissionsMap {
+		if !snapshot.IsChanged(orgName) {
+			delete(grafanaPermissionsMap, orgName)
+		}
+	}
+	err = reconcilePermissions(ctx, grafanaPermissionsMap, grafanaOrgsMap, protectedLogins, grafanaClient)
+	if err != nil {
+		return err
+	}
+
+	if config.GrafanaSyncTeams {
+		klog.Infof("Checking teams...")
+		err = reconcileAllTeams(ctx, snapshot, grafanaOrgsMap, protectedLogins, grafanaClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("Checking folder permissions...")
+	err = reconcileAllFolderPermissions(ctx, config, snapshot, grafanaOrgsMap, grafanaClient)
 	if err != nil {
 		return err
 	}
@@ -86,16 +133,26 @@ outAdmins:
 		if err != nil {
 			return err
 		}
-		klog.Infof("Removing members of auto_assign_org %d", autoAssignOrgId)
+		role := "Viewer"
+		if config.GrafanaAutoAssignOrgRole != "" {
+			role = normalizeRole(config.GrafanaAutoAssignOrgRole)
+			if role == "" {
+				return fmt.Errorf("Invalid role for auto_assign_org: '%s'", config.GrafanaAutoAssignOrgRole)
+			}
+		}
+		klog.Infof("Checking permissions of auto_assign_org %d, %d users should be members", autoAssignOrgId, len(snapshot.AutoAssignOrgMembers))
 		var permissions []GrafanaPermissionSpec
-		err = reconcileSingleOrgPermissions(ctx, permissions, autoAssignOrgId, grafanaClient)
+		for _, user := range snapshot.AutoAssignOrgMembers {
+			permissions = append(permissions, GrafanaPermissionSpec{Uid: user.Username, PermittedRoles: getPermittedRoles(role)})
+		}
+		err = reconcileSingleOrgPermissions(ctx, permissions, autoAssignOrgId, protectedLogins, grafanaClient)
 		if err != nil {
 			return err
 		}
 	}
 
 	grafanaClient.CloseIdleConnections()
-	keycloakClient.CloseIdleConnections()
+	identitySource.CloseIdleConnections()
 
 	return nil
 }
@@ -105,31 +162,58 @@ type GrafanaPermissionSpec struct {
 	PermittedRoles []string
 }
 
-// Convert group memberships found in Keycloak into permissions on organizations in Grafana
-func getGrafanaPermissionsMap(keycloakUserGroups map[*KeycloakUser][]*KeycloakGroup, keycloakAdmins []*KeycloakUser, keycloakOrganizations []*KeycloakGroup) map[string][]GrafanaPermissionSpec {
+// Convert memberships found in the identity source into permissions on organizations in Grafana
+func getGrafanaPermissionsMap(config Config, snapshot *IdentitySnapshot) map[string][]GrafanaPermissionSpec {
+	roleMapping := config.RoleMapping
+	if roleMapping == nil {
+		roleMapping = &RoleMapping{DefaultRole: "Editor"}
+	}
+	supportRole := "Viewer"
+	if config.GrafanaSupportRole != "" {
+		supportRole = normalizeRole(config.GrafanaSupportRole)
+	}
+
 	permissionsMap := make(map[string][]GrafanaPermissionSpec)
-	for _, keycloakOrganization := range keycloakOrganizations {
-		permissionsMap[keycloakOrganization.Name] = []GrafanaPermissionSpec{}
-
-	userLoop:
-		for keycloakUser, groups := range keycloakUserGroups {
-			// If this user is an admin we ignore any specific organization permissions
-			for _, admin := range keycloakAdmins {
-				if admin.Username == keycloakUser.Username {
-					continue userLoop
-				}
+	for _, organization := range snapshot.Organizations {
+		permissionsMap[organization.Name] = []GrafanaPermissionSpec{}
+
+		for user, memberships := range snapshot.Memberships {
+			// If this user is an admin we ignore any specific organization permissions, support users are handled below
+			if snapshot.IsAdmin(user) || snapshot.IsSupportUser(user) {
+				continue
 			}
-			for _, group := range groups {
-				if keycloakOrganization.IsSameOrganization(group) {
-					permissionsMap[keycloakOrganization.GetOrganizationName()] = append(permissionsMap[keycloakOrganization.GetOrganizationName()], GrafanaPermissionSpec{Uid: keycloakUser.Username, PermittedRoles: []string{"Editor", "Viewer"}})
-					continue userLoop // don't try to find further permissions, otherwise we may get more than one permission for the same user on the same org
-				}
+			// all memberships in this organization are considered at once, otherwise we may get more than one permission for the same user on the same org
+			role := roleMapping.getRole(getOrganizationMemberships(memberships, organization))
+			if role != "" {
+				permissionsMap[organization.Name] = append(permissionsMap[organization.Name], GrafanaPermissionSpec{Uid: user.Username, PermittedRoles: getPermittedRoles(role)})
 			}
 		}
 
-		for _, admin := range keycloakAdmins {
-			permissionsMap[keycloakOrganization.Name] = append(permissionsMap[keycloakOrganization.Name], GrafanaPermissionSpec{Uid: admin.Username, PermittedRoles: []string{"Admin", "Editor", "Viewer"}})
+		for _, supportUser := range snapshot.SupportUsers {
+			if snapshot.IsAdmin(supportUser) {
+				continue
+			}
+			// Support users who are members of the organization keep their role if it's higher
+			role := roleMapping.getRole(getOrganizationMemberships(snapshot.Memberships[supportUser], organization))
+			if getRoleRank(supportRole) > getRoleRank(role) {
+				role = supportRole
+			}
+			permissionsMap[organization.Name] = append(permissionsMap[organization.Name], GrafanaPermissionSpec{Uid: supportUser.Username, PermittedRoles: getPermittedRoles(role)})
+		}
+
+		for _, admin := range snapshot.Admins {
+			permissionsMap[organization.Name] = append(permissionsMap[organization.Name], GrafanaPermissionSpec{Uid: admin.Username, PermittedRoles: getPermittedRoles("Admin")})
 		}
 	}
 	return permissionsMap
 }
+
+func getOrganizationMemberships(memberships []*Membership, organization *Organization) []*Membership {
+	var organizationMemberships []*Membership
+	for _, membership := range memberships {
+		if membership.Organization == organization {
+			organizationMemberships = append(organizationMemberships, membership)
+		}
+	}
+	return organizationMemberships
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	grafana "github.com/grafana/grafana-api-golang-client"
+	"k8s.io/klog/v2"
+	"reflect"
+	"strings"
+)
+
+// Grantee of a folder permission, exactly one of the fields is set
+type folderPermissionKey struct {
+	teamId int64
+	userId int64
+	role   string
+}
+
+// Teams missing in Grafana are only logged once per folder, key is org, folder and team
+var missingFolderTeamsWarned = make(map[string]bool)
+
+// Folder permissions are checked in every cycle, also incremental ones, otherwise permissions changed in Grafana would only
+// be reset by the next full sync
+func reconcileAllFolderPermissions(ctx context.Context, config Config, snapshot *IdentitySnapshot, grafanaOrgsMap map[string]*grafana.Org, grafanaClient *GrafanaClient) error {
+	for _, organization := range snapshot.Organizations {
+		folders := config.FolderPermissions.getOrgFolderPermissions(organization)
+		if len(folders) == 0 {
+			continue
+		}
+		grafanaOrg, ok := grafanaOrgsMap[organization.Name]
+		if !ok {
+			continue
+		}
+		err := reconcileOrgFolderPermissions(grafanaOrg, folders, grafanaClient)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return interruptedError
+		default:
+		}
+	}
+	return nil
+}
+
+// The permissions of the folders are set to exactly the desired ones, anything else (e.g. permissions added manually) is removed.
+// Permissions of the "Admin" role are ignored, admins always have full access.
+func reconcileOrgFolderPermissions(grafanaOrg *grafana.Org, folders map[string][]FolderPermissionRuleItem, grafanaClient *GrafanaClient) error {
+	grafanaTeams, err := grafanaClient.Teams(grafanaOrg)
+	if err != nil {
+		return err
+	}
+	teamIds := make(map[string]int64)
+	for _, grafanaTeam := range grafanaTeams {
+		nameComponents := strings.Split(grafanaTeam.Name, " - ")
+		if len(nameComponents) < 2 || strings.Contains(nameComponents[0], " ") {
+			continue
+		}
+		teamIds[nameComponents[0]] = grafanaTeam.ID
+	}
+
+	for title, items := range folders {
+		// value is the permission level
+		desiredPermissions := make(map[folderPermissionKey]int64)
+		teamsMissing := false
+		for _, item := range items {
+			key := folderPermissionKey{role: item.Role}
+			if item.Team != "" {
+				warnedKey := grafanaOrg.Name + "\x00" + title + "\x00" + item.Team
+				teamId, ok := teamIds[item.Team]
+				if !ok {
+					if !missingFolderTeamsWarned[warnedKey] {
+						missingFolderTeamsWarned[warnedKey] = true
+						klog.Warningf("Team '%s' not found in org '%s' (%d), leaving permissions of folder '%s' unchanged", item.Team, grafanaOrg.Name, grafanaOrg.ID, title)
+					}
+					teamsMissing = true
+					continue
+				}
+				delete(missingFolderTeamsWarned, warnedKey)
+				key = folderPermissionKey{teamId: teamId}
+			}
+			if permission := grafanaFolderPermissions[item.Permission]; permission > desiredPermissions[key] {
+				desiredPermissions[key] = permission
+			}
+		}
+		// setting only the other permissions could lock everybody out of the folder
+		if teamsMissing {
+			continue
+		}
+
+		folder, err := reconcileOrgDashboardFolder(grafanaOrg, grafanaClient, title)
+		if err != nil {
+			return err
+		}
+
+		permissions, err := grafanaClient.FolderPermissions(grafanaOrg, folder.UID)
+		if err != nil {
+			return err
+		}
+		currentPermissions := make(map[folderPermissionKey]int64)
+		for _, permission := range permissions {
+			switch {
+			case permission.TeamID > 0:
+				currentPermissions[folderPermissionKey{teamId: permission.TeamID}] = permission.Permission
+			case permission.UserID > 0:
+				currentPermissions[folderPermissionKey{userId: permission.UserID}] = permission.Permission
+			case permission.Role != "" && permission.Role != "Admin":
+				currentPermissions[folderPermissionKey{role: permission.Role}] = permission.Permission
+			}
+		}
+
+		if reflect.DeepEqual(currentPermissions, desiredPermissions) {
+			continue
+		}
+
+		klog.Infof("Folder '%s' in org '%s' (%d) has wrong permissions, fixing", title, grafanaOrg.Name, grafanaOrg.ID)
+		permissionItems := &grafana.PermissionItems{Items: []*grafana.PermissionItem{}}
+		for key, permission := range desiredPermissions {
+			permissionItems.Items = append(permissionItems.Items, &grafana.PermissionItem{Role: key.role, TeamID: key.teamId, UserID: key.userId, Permission: permission})
+		}
+		err = grafanaClient.UpdateFolderPermissions(grafanaOrg, folder.UID, permissionItems)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
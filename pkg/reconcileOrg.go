@@ -8,14 +8,10 @@ import (
 )
 
 // Sync the basic org. Uses the generic Grafana client.
-func reconcileOrgBasic(grafanaOrgLookup map[string]grafana.Org, grafanaClient *GrafanaClient, keycloakOrganization *KeycloakGroup) (*grafana.Org, error) {
-	displayName := keycloakOrganization.Name
-	if keycloakOrganization.GetDisplayNameAttribute() != "" {
-		displayName = keycloakOrganization.GetDisplayNameAttribute()
-	}
-	grafanaOrgDesiredName := keycloakOrganization.Name + " - " + displayName
+func reconcileOrgBasic(grafanaOrgLookup map[string]grafana.Org, grafanaClient *GrafanaClient, organization *Organization) (*grafana.Org, error) {
+	grafanaOrgDesiredName := organization.Name + " - " + organization.GetDisplayName()
 
-	if grafanaOrg, ok := grafanaOrgLookup[keycloakOrganization.Name]; ok {
+	if grafanaOrg, ok := grafanaOrgLookup[organization.Name]; ok {
 		if grafanaOrg.Name != grafanaOrgDesiredName {
 			klog.Infof("Organization %d has wrong name: '%s', should be '%s'", grafanaOrg.ID, grafanaOrg.Name, grafanaOrgDesiredName)
 			err := grafanaClient.UpdateOrg(grafanaOrg.ID, grafanaOrgDesiredName)
@@ -7,7 +7,8 @@ import (
 	"strings"
 )
 
-func reconcileAllOrgs(ctx context.Context, config Config, keycloakOrganizations []*KeycloakGroup, grafanaClient *GrafanaClient, dashboards []Dashboard) (map[string]*grafana.Org, error) {
+// Organizations that are unchanged according to the snapshot are created if they are missing, but their settings aren't checked
+func reconcileAllOrgs(ctx context.Context, config Config, snapshot *IdentitySnapshot, grafanaClient *GrafanaClient, dashboards []Dashboard) (map[string]*grafana.Org, error) {
 	grafanaOrgLookupFinal := make(map[string]*grafana.Org)
 
 	// Get all orgs from Grafana
@@ -27,19 +28,22 @@ func reconcileAllOrgs(ctx context.Context, config Config, keycloakOrganizations
 	}
 
 	// first make sure that all orgs that need to be present are present
-	for _, keycloakOrganization := range keycloakOrganizations {
-		grafanaOrg, err := reconcileOrgBasic(grafanaOrgLookup, grafanaClient, keycloakOrganization)
+	for _, organization := range snapshot.Organizations {
+		_, exists := grafanaOrgLookup[organization.Name]
+		grafanaOrg, err := reconcileOrgBasic(grafanaOrgLookup, grafanaClient, organization)
 		if err != nil {
 			return nil, err
 		}
-		delete(grafanaOrgLookup, keycloakOrganization.Name)
+		delete(grafanaOrgLookup, organization.Name)
 
-		err = reconcileOrgSettings(config, grafanaOrg, keycloakOrganization.Name, grafanaClient, dashboards)
-		if err != nil {
-			return nil, err
+		if !exists || snapshot.IsChanged(organization.Name) {
+			err = reconcileOrgSettings(config, grafanaOrg, organization.Name, grafanaClient, dashboards)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		grafanaOrgLookupFinal[keycloakOrganization.Name] = grafanaOrg
+		grafanaOrgLookupFinal[organization.Name] = grafanaOrg
 
 		// select with a default case is apparently the only way to do a non-blocking read from a channel
 		select {
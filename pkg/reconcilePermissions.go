@@ -8,7 +8,7 @@ import (
 	"k8s.io/utils/strings/slices"
 )
 
-func reconcileSingleOrgPermissions(ctx context.Context, grafanaPermissions []GrafanaPermissionSpec, grafanaOrgId int64, grafanaClient *GrafanaClient) error {
+func reconcileSingleOrgPermissions(ctx context.Context, grafanaPermissions []GrafanaPermissionSpec, grafanaOrgId int64, protectedLogins map[string]bool, grafanaClient *GrafanaClient) error {
 	grafanaOrg, err := grafanaClient.Org(grafanaOrgId)
 	if err != nil {
 		return err
@@ -20,14 +20,15 @@ func reconcileSingleOrgPermissions(ctx context.Context, grafanaPermissions []Gra
 	grafanaOrgsMap := make(map[string]*grafana.Org)
 	grafanaOrgsMap["auto_assign_org"] = &grafanaOrg
 
-	return reconcilePermissions(ctx, grafanaPermissionsMap, grafanaOrgsMap, grafanaClient)
+	return reconcilePermissions(ctx, grafanaPermissionsMap, grafanaOrgsMap, protectedLogins, grafanaClient)
 }
 
-func reconcilePermissions(ctx context.Context, grafanaPermissionsMap map[string][]GrafanaPermissionSpec, grafanaOrgsMap map[string]*grafana.Org, grafanaClient *GrafanaClient) error {
+// The permissions of protected users are never changed
+func reconcilePermissions(ctx context.Context, grafanaPermissionsMap map[string][]GrafanaPermissionSpec, grafanaOrgsMap map[string]*grafana.Org, protectedLogins map[string]bool, grafanaClient *GrafanaClient) error {
 	for orgName, permissions := range grafanaPermissionsMap {
 		grafanaOrg, ok := grafanaOrgsMap[orgName]
 		if !ok {
-			return errors.New("Internal error: Keycloak organization not present in Grafana. This shouldn't happen.")
+			return errors.New("Internal error: organization not present in Grafana. This shouldn't happen.")
 		}
 		initialOrgUsers, err := grafanaClient.OrgUsers(grafanaOrg.ID)
 		if err != nil {
@@ -35,6 +36,9 @@ func reconcilePermissions(ctx context.Context, grafanaPermissionsMap map[string]
 		}
 
 		for _, permission := range permissions {
+			if protectedLogins[permission.Uid] {
+				continue
+			}
 			var desiredOrgUser *grafana.OrgUser
 
 			for i, ou := range initialOrgUsers {
@@ -74,7 +78,7 @@ func reconcilePermissions(ctx context.Context, grafanaPermissionsMap map[string]
 		}
 
 		for _, undesiredOrgUser := range initialOrgUsers {
-			if undesiredOrgUser.Login == "admin" || undesiredOrgUser.Login == grafanaClient.GetUsername() {
+			if protectedLogins[undesiredOrgUser.Login] {
 				continue
 			}
 			klog.Infof("User '%s' (%d) must not have access to org '%s' (%d), removing", undesiredOrgUser.Login, undesiredOrgUser.UserID, grafanaOrg.Name, grafanaOrg.ID)
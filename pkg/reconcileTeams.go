@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"context"
+	grafana "github.com/grafana/grafana-api-golang-client"
+	"k8s.io/klog/v2"
+	"strings"
+)
+
+// Teams of all organizations, including the ones only referenced by memberships. Key is the organization name, then the team name.
+func getTeamsMap(snapshot *IdentitySnapshot) map[string]map[string]*Team {
+	teamsMap := make(map[string]map[string]*Team)
+	for _, organization := range snapshot.Organizations {
+		teamsMap[organization.Name] = make(map[string]*Team)
+		for _, team := range organization.Teams {
+			teamsMap[organization.Name][team.Name] = team
+		}
+	}
+	for _, memberships := range snapshot.Memberships {
+		for _, membership := range memberships {
+			teams, ok := teamsMap[membership.Organization.Name]
+			if !ok || membership.Team == "" {
+				continue
+			}
+			if _, ok := teams[membership.Team]; !ok {
+				teams[membership.Team] = &Team{Name: membership.Team}
+			}
+		}
+	}
+	return teamsMap
+}
+
+// Team members, key is the organization name, then the team name, then the username
+func getTeamMembersMap(snapshot *IdentitySnapshot) map[string]map[string]map[string]bool {
+	teamMembersMap := make(map[string]map[string]map[string]bool)
+	for user, memberships := range snapshot.Memberships {
+		for _, membership := range memberships {
+			if membership.Team == "" {
+				continue
+			}
+			if teamMembersMap[membership.Organization.Name] == nil {
+				teamMembersMap[membership.Organization.Name] = make(map[string]map[string]bool)
+			}
+			if teamMembersMap[membership.Organization.Name][membership.Team] == nil {
+				teamMembersMap[membership.Organization.Name][membership.Team] = make(map[string]bool)
+			}
+			teamMembersMap[membership.Organization.Name][membership.Team][user.Username] = true
+		}
+	}
+	return teamMembersMap
+}
+
+// Teams are represented in Grafana as "[Name] - [DisplayName]", teams with other names are not touched
+func reconcileAllTeams(ctx context.Context, snapshot *IdentitySnapshot, grafanaOrgsMap map[string]*grafana.Org, protectedLogins map[string]bool, grafanaClient *GrafanaClient) error {
+	teamsMap := getTeamsMap(snapshot)
+	teamMembersMap := getTeamMembersMap(snapshot)
+
+	for orgName, teams := range teamsMap {
+		if !snapshot.IsChanged(orgName) {
+			continue
+		}
+		grafanaOrg, ok := grafanaOrgsMap[orgName]
+		if !ok {
+			continue
+		}
+		err := reconcileOrgTeams(ctx, grafanaOrg, teams, teamMembersMap[orgName], protectedLogins, grafanaClient)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconcileOrgTeams(ctx context.Context, grafanaOrg *grafana.Org, teams map[string]*Team, teamMembers map[string]map[string]bool, protectedLogins map[string]bool, grafanaClient *GrafanaClient) error {
+	grafanaTeams, err := grafanaClient.Teams(grafanaOrg)
+	if err != nil {
+		return err
+	}
+	grafanaTeamLookup := make(map[string]*grafana.Team)
+	for _, grafanaTeam := range grafanaTeams {
+		nameComponents := strings.Split(grafanaTeam.Name, " - ")
+		if len(nameComponents) < 2 || strings.Contains(nameComponents[0], " ") {
+			continue
+		}
+		grafanaTeamLookup[nameComponents[0]] = grafanaTeam
+	}
+
+	// Team members must be members of the organization, which is ensured by reconcilePermissions()
+	orgUsers, err := grafanaClient.OrgUsers(grafanaOrg.ID)
+	if err != nil {
+		return err
+	}
+	userIds := make(map[string]int64)
+	for _, orgUser := range orgUsers {
+		userIds[orgUser.Login] = orgUser.UserID
+	}
+
+	for _, team := range teams {
+		if strings.Contains(team.Name, " ") {
+			klog.Warningf("Team name '%s' in org '%s' is invalid, ignoring team", team.Name, grafanaOrg.Name)
+			continue
+		}
+		displayName := team.Name + " - " + team.GetDisplayName()
+
+		grafanaTeam, ok := grafanaTeamLookup[team.Name]
+		delete(grafanaTeamLookup, team.Name)
+		var teamId int64
+		if !ok {
+			klog.Infof("Team '%s' in org '%s' (%d) missing, creating", displayName, grafanaOrg.Name, grafanaOrg.ID)
+			teamId, err = grafanaClient.NewTeam(grafanaOrg, displayName)
+			if err != nil {
+				return err
+			}
+		} else {
+			teamId = grafanaTeam.ID
+			if grafanaTeam.Name != displayName {
+				klog.Infof("Team %d in org '%s' (%d) has wrong name, renaming to '%s'", teamId, grafanaOrg.Name, grafanaOrg.ID, displayName)
+				err = grafanaClient.UpdateTeam(grafanaOrg, teamId, displayName)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		members, err := grafanaClient.TeamMembers(grafanaOrg, teamId)
+		if err != nil {
+			return err
+		}
+		desiredMembers := teamMembers[team.Name]
+		existingMembers := make(map[string]bool)
+		for _, member := range members {
+			existingMembers[member.Login] = true
+			if !desiredMembers[member.Login] && !protectedLogins[member.Login] {
+				klog.Infof("User '%s' must not be member of team '%s' in org '%s' (%d), removing", member.Login, displayName, grafanaOrg.Name, grafanaOrg.ID)
+				err = grafanaClient.RemoveTeamMember(grafanaOrg, teamId, member.UserID)
+				if err != nil {
+					// This can happen due to race conditions, hence just a warning
+					klog.Warning(err)
+				}
+			}
+		}
+		for username := range desiredMembers {
+			if existingMembers[username] {
+				continue
+			}
+			userId, ok := userIds[username]
+			if !ok {
+				continue
+			}
+			klog.Infof("User '%s' should be member of team '%s' in org '%s' (%d), adding", username, displayName, grafanaOrg.Name, grafanaOrg.ID)
+			err = grafanaClient.AddTeamMember(grafanaOrg, teamId, userId)
+			if err != nil {
+				// This can happen due to race conditions, hence just a warning
+				klog.Warning(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return interruptedError
+		default:
+		}
+	}
+
+	for _, grafanaTeamToBeDeleted := range grafanaTeamLookup {
+		klog.Infof("Team %d in org '%s' (%d) should not exist, deleting: '%s'", grafanaTeamToBeDeleted.ID, grafanaOrg.Name, grafanaOrg.ID, grafanaTeamToBeDeleted.Name)
+		err = grafanaClient.DeleteTeam(grafanaOrg, grafanaTeamToBeDeleted.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -21,25 +21,29 @@ func generatePassword() (string, error) {
 	return pw, nil
 }
 
-func createUser(client *GrafanaClient, keycloakUser *KeycloakUser) (*grafana.User, error) {
+func createUser(client *GrafanaClient, user *User) (*grafana.User, error) {
 	password, err := generatePassword()
 	if err != nil {
 		return nil, err
 	}
 	grafanaUser := grafana.User{
-		Email:    keycloakUser.Email,
-		Login:    keycloakUser.Username,
-		Name:     keycloakUser.GetDisplayName(),
+		Email:    user.Email,
+		Login:    user.Username,
+		Name:     user.GetDisplayName(),
 		Password: password,
 	}
 	grafanaUser.ID, err = client.CreateUser(grafanaUser)
 	if err != nil {
 		return nil, err
 	}
+	return &grafanaUser, nil
+}
 
+// Must be called right after createUser()
+func removeUserFromOrgs(client *GrafanaClient, grafanaUser grafana.User) error {
 	userOrgs, err := client.GetUserOrgs(grafanaUser)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	for _, userOrg := range userOrgs {
@@ -47,9 +51,8 @@ func createUser(client *GrafanaClient, keycloakUser *KeycloakUser) (*grafana.Use
 		// yes this is stupid but that's how Grafana works
 		err = client.RemoveOrgUser(userOrg.OrgID, grafanaUser.ID)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-
-	return &grafanaUser, nil
+	return nil
 }
@@ -4,55 +4,248 @@ import (
 	"context"
 	grafana "github.com/grafana/grafana-api-golang-client"
 	"k8s.io/klog/v2"
+	"time"
 )
 
-func reconcileUsers(ctx context.Context, keycloakUsers []*KeycloakUser, grafanaClient *GrafanaClient) ([]*KeycloakUser, error) {
-	var syncedUsers []*KeycloakUser
-	grafanaUsers, err := grafanaClient.Users()
-	if err != nil {
-		return nil, err
-	}
+// Protected users are neither updated nor deleted, and they aren't part of the returned synced users.
+// Users are matched by their ID in the identity source if they have been matched before (see UserState), so renamed users keep their Grafana user.
+// Also returns the Grafana users as they are after the renames and deletions.
+func reconcileUsers(ctx context.Context, config Config, users []*User, grafanaUsers []grafana.UserSearch, protectedLogins map[string]bool, grafanaClient *GrafanaClient) ([]*User, []grafana.UserSearch, error) {
+	var syncedUsers []*User
+	var err error
 	grafanaUsersMap := make(map[string]grafana.UserSearch)
+	grafanaUsersById := make(map[int64]grafana.UserSearch)
 	for _, grafanaUser := range grafanaUsers {
-		if grafanaUser.Login != "admin" && grafanaUser.Login != grafanaClient.GetUsername() { // ignore admin
+		if !protectedLogins[grafanaUser.Login] {
 			grafanaUsersMap[grafanaUser.Login] = grafanaUser
+			grafanaUsersById[grafanaUser.ID] = grafanaUser
 		}
 	}
 
-	for _, keycloakUser := range keycloakUsers {
+	var knownUserIds map[string]int64
+	if config.UserState != nil {
+		knownUserIds = config.UserState.state.UserIds
+	}
+	mapping := newUserIdMapping(knownUserIds, users)
+	userIds := make(map[string]int64)
+	matchedGrafanaIds := make(map[int64]bool)
+	renamedLogins := make(map[int64]string)
+
+	for _, user := range users {
+		select {
+		case <-ctx.Done():
+			return nil, nil, interruptedError
+		default:
+		}
+
 		var grafanaUser *grafana.User
-		if grafanaUserSearch, ok := grafanaUsersMap[keycloakUser.Username]; ok {
-			if grafanaUserSearch.Email != keycloakUser.Email ||
-				grafanaUserSearch.IsAdmin ||
-				grafanaUserSearch.Login != keycloakUser.Username ||
-				grafanaUserSearch.Name != keycloakUser.GetDisplayName() {
-				klog.Infof("User '%s' differs, fixing", keycloakUser.Username)
+		grafanaUserSearch, ok := mapping.findGrafanaUser(user, grafanaUsersMap, grafanaUsersById)
+		if ok {
+			if matchedGrafanaIds[grafanaUserSearch.ID] {
+				klog.Warningf("User '%s' (%d) matches several users in identity source, ignoring '%s'", grafanaUserSearch.Login, grafanaUserSearch.ID, user.Username)
+				continue
+			}
+			matchedGrafanaIds[grafanaUserSearch.ID] = true
+			delete(grafanaUsersMap, grafanaUserSearch.Login)
+			if user.Id != "" {
+				userIds[user.Id] = grafanaUserSearch.ID
+			}
+
+			if grafanaUserSearch.Email != user.Email ||
+				grafanaUserSearch.Login != user.Username ||
+				grafanaUserSearch.Name != user.GetDisplayName() {
+				if grafanaUserSearch.Login != user.Username {
+					klog.Infof("User '%s' (%d) has been renamed in identity source, renaming to '%s'", grafanaUserSearch.Login, grafanaUserSearch.ID, user.Username)
+				} else {
+					klog.Infof("User '%s' differs, fixing", user.Username)
+				}
 				grafanaUser = &grafana.User{
 					ID:      grafanaUserSearch.ID,
-					IsAdmin: false,
-					Login:   keycloakUser.Username,
-					Name:    keycloakUser.GetDisplayName(),
-					Email:   keycloakUser.Email,
+					IsAdmin: grafanaUserSearch.IsAdmin, // see reconcileServerAdmins()
+					Login:   user.Username,
+					Name:    user.GetDisplayName(),
+					Email:   user.Email,
+				}
+				err = grafanaClient.UserUpdate(*grafanaUser)
+				if err != nil {
+					if grafanaUserSearch.Login != user.Username {
+						// e.g. because Grafana already created a user with the new login, retried during the next reconciliation
+						klog.Warningf("Could not rename user '%s' (%d): %v", grafanaUserSearch.Login, grafanaUserSearch.ID, err)
+						continue
+					}
+					// This can happen due to race conditions, hence just a warning
+					klog.Warning(err)
+				} else if grafanaUserSearch.Login != user.Username {
+					renamedLogins[grafanaUserSearch.ID] = user.Username
 				}
-				grafanaClient.UserUpdate(*grafanaUser)
 			}
-			syncedUsers = append(syncedUsers, keycloakUser)
-		}
-		// For now we do not create users in Grafana.
-		// The original thought of this was that it would be possible to set up the users and permissions before the user logs in for the first time, therefore providing him/her with correct permissions upon first login.
-		// Turns out this doesn't work, as with the first OAuth login Grafana resets all permissions of the user, breaking this entire scheme.
-		// Instead now we let Grafana create the user with invalid permissions, then we go and fix the permissions.
-		/*
-			else {
-				klog.Infof("User '%s' is missing, adding", keycloakUser.Username)
-				grafanaUser, err = createUser(grafanaClient, keycloakUser)
+			// users disabled by removeMissingUsers() are enabled again even if the source doesn't know whether they're enabled
+			syncEnabledState := user.Disabled != nil || config.UserState.isMissing(grafanaUserSearch.ID)
+			if syncEnabledState && grafanaUserSearch.IsDisabled != user.IsDisabled() {
+				if user.IsDisabled() {
+					klog.Infof("User '%s' (%d) is disabled in identity source, disabling", user.Username, grafanaUserSearch.ID)
+					err = grafanaClient.DisableUser(grafanaUserSearch.ID)
+				} else {
+					klog.Infof("User '%s' (%d) is enabled in identity source, enabling", user.Username, grafanaUserSearch.ID)
+					err = grafanaClient.EnableUser(grafanaUserSearch.ID)
+				}
 				if err != nil {
-					// for now just continue in case errors happen
-					klog.Error(err)
-					continue
+					// This can happen due to race conditions, hence just a warning
+					klog.Warning(err)
 				}
-			}*/
-		delete(grafanaUsersMap, keycloakUser.Username)
+			}
+			syncedUsers = append(syncedUsers, user)
+		}
+		// Missing users are only created by provisionUsers(), as this requires the memberships.
+		// Otherwise we let Grafana create the user with invalid permissions on first login, then we go and fix the permissions.
+	}
+
+	// Grafana users which still exist keep their mapping, e.g. users missing in the identity source during the grace
+	// period, so they are matched by ID again if they show up again renamed
+	existingGrafanaIds := make(map[int64]bool)
+	for _, grafanaUser := range grafanaUsers {
+		existingGrafanaIds[grafanaUser.ID] = true
+	}
+	for sourceId, grafanaId := range knownUserIds {
+		if _, ok := userIds[sourceId]; !ok && existingGrafanaIds[grafanaId] && !matchedGrafanaIds[grafanaId] {
+			userIds[sourceId] = grafanaId
+		}
+	}
+
+	if config.UserState != nil {
+		changed := config.UserState.forgetProvisionedUsers(grafanaUsers)
+		if !equalUserIds(userIds, knownUserIds) {
+			config.UserState.state.UserIds = userIds
+			changed = true
+		}
+		if changed {
+			err = config.UserState.save()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	deletedIds, err := removeMissingUsers(ctx, config, grafanaUsersMap, grafanaClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	currentGrafanaUsers := make([]grafana.UserSearch, 0, len(grafanaUsers))
+	for _, grafanaUser := range grafanaUsers {
+		if deletedIds[grafanaUser.ID] {
+			continue
+		}
+		if login, ok := renamedLogins[grafanaUser.ID]; ok {
+			grafanaUser.Login = login
+		}
+		currentGrafanaUsers = append(currentGrafanaUsers, grafanaUser)
+	}
+	return syncedUsers, currentGrafanaUsers, nil
+}
+
+// Known mappings of users of the identity source to Grafana users, see UserState
+type userIdMapping struct {
+	grafanaIds        map[string]int64 // key is User.Id
+	sourceIds         map[int64]string // key is the Grafana user ID
+	existingSourceIds map[string]bool  // IDs of the users currently in the identity source
+}
+
+func newUserIdMapping(knownUserIds map[string]int64, users []*User) *userIdMapping {
+	mapping := &userIdMapping{
+		grafanaIds:        knownUserIds,
+		sourceIds:         make(map[int64]string),
+		existingSourceIds: make(map[string]bool),
+	}
+	for sourceId, grafanaId := range knownUserIds {
+		mapping.sourceIds[grafanaId] = sourceId
+	}
+	for _, user := range users {
+		if user.Id != "" {
+			mapping.existingSourceIds[user.Id] = true
+		}
+	}
+	return mapping
+}
+
+// Users matched before are found by their ID in the identity source, otherwise by login. The login doesn't match if the
+// Grafana user is mapped to another user who still exists in the identity source, i.e. who has been renamed. Mappings to
+// users who don't exist anymore (e.g. deleted and recreated with the same login, or after switching the identity source)
+// are ignored, the caller replaces them.
+func (this *userIdMapping) findGrafanaUser(user *User, grafanaUsersByLogin map[string]grafana.UserSearch, grafanaUsersById map[int64]grafana.UserSearch) (grafana.UserSearch, bool) {
+	if grafanaId, known := this.grafanaIds[user.Id]; known && user.Id != "" {
+		if grafanaUser, exists := grafanaUsersById[grafanaId]; exists {
+			return grafanaUser, true
+		}
+	}
+	grafanaUser, ok := grafanaUsersByLogin[user.Username]
+	if !ok {
+		return grafana.UserSearch{}, false
+	}
+	if sourceId, mapped := this.sourceIds[grafanaUser.ID]; mapped && sourceId != user.Id && this.existingSourceIds[sourceId] {
+		return grafana.UserSearch{}, false
+	}
+	return grafanaUser, true
+}
+
+// Users not found in the identity source are deleted. With a grace period they are disabled first and only deleted
+// once they have been missing for the whole grace period, so a glitch of the identity source doesn't destroy their
+// preferences and personal dashboards. Users showing up again in the meantime are enabled again by reconcileUsers().
+// Returns the IDs of the deleted users.
+func removeMissingUsers(ctx context.Context, config Config, missingUsers map[string]grafana.UserSearch, grafanaClient *GrafanaClient) (map[int64]bool, error) {
+	deletedIds := make(map[int64]bool)
+	if config.UserDeletionGracePeriod <= 0 || config.UserState == nil {
+		for _, grafanaUser := range missingUsers {
+			klog.Infof("User '%s' (%d) not found in identity source, removing", grafanaUser.Login, grafanaUser.ID)
+			err := grafanaClient.DeleteUser(grafanaUser.ID)
+			if err != nil {
+				// the user is removed during the next reconciliation
+				klog.Warning(err)
+			} else {
+				deletedIds[grafanaUser.ID] = true
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, interruptedError
+			default:
+			}
+		}
+		return deletedIds, nil
+	}
+
+	state := &config.UserState.state
+	now := time.Now()
+	changed := false
+	missingUserIds := make(map[int64]bool)
+	for _, grafanaUser := range missingUsers {
+		missingUserIds[grafanaUser.ID] = true
+		missingUser, ok := state.MissingUsers[grafanaUser.ID]
+		if !ok {
+			klog.Infof("User '%s' (%d) not found in identity source, disabling (will be removed after %s)", grafanaUser.Login, grafanaUser.ID, config.UserDeletionGracePeriod)
+			state.MissingUsers[grafanaUser.ID] = &MissingUser{Login: grafanaUser.Login, MissingSince: now}
+			changed = true
+		} else if now.Sub(missingUser.MissingSince) >= config.UserDeletionGracePeriod {
+			klog.Infof("User '%s' (%d) not found in identity source since %s, removing", grafanaUser.Login, grafanaUser.ID, missingUser.MissingSince.Format(time.RFC3339))
+			err := grafanaClient.DeleteUser(grafanaUser.ID)
+			if err != nil {
+				// the user is removed during the next reconciliation
+				klog.Warning(err)
+				continue
+			}
+			delete(state.MissingUsers, grafanaUser.ID)
+			deletedIds[grafanaUser.ID] = true
+			changed = true
+			continue
+		}
+		// also if somebody enabled the user manually in the meantime
+		if !grafanaUser.IsDisabled {
+			err := grafanaClient.DisableUser(grafanaUser.ID)
+			if err != nil {
+				// This can happen due to race conditions, hence just a warning
+				klog.Warning(err)
+			}
+		}
 
 		select {
 		case <-ctx.Done():
@@ -61,9 +254,102 @@ func reconcileUsers(ctx context.Context, keycloakUsers []*KeycloakUser, grafanaC
 		}
 	}
 
-	for _, grafanaUser := range grafanaUsersMap {
-		klog.Infof("User '%s' (%d) not found in Keycloak, removing", grafanaUser.Login, grafanaUser.ID)
-		grafanaClient.DeleteUser(grafanaUser.ID)
+	for id, missingUser := range state.MissingUsers {
+		if !missingUserIds[id] {
+			klog.Infof("User '%s' (%d) no longer missing in identity source or deleted manually, forgetting it", missingUser.Login, id)
+			delete(state.MissingUsers, id)
+			changed = true
+		}
+	}
+
+	if changed {
+		err := config.UserState.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deletedIds, nil
+}
+
+// Server admins are managed separately from the other user properties because they are only known once the snapshot has been fetched.
+// Users that aren't server admins according to the snapshot are demoted.
+func reconcileServerAdmins(ctx context.Context, snapshot *IdentitySnapshot, grafanaUsers []grafana.UserSearch, protectedLogins map[string]bool, grafanaClient *GrafanaClient) error {
+	for _, grafanaUser := range grafanaUsers {
+		if protectedLogins[grafanaUser.Login] {
+			continue
+		}
+		isServerAdmin := snapshot.IsServerAdmin(grafanaUser.Login)
+		if grafanaUser.IsAdmin == isServerAdmin {
+			continue
+		}
+		if isServerAdmin {
+			klog.Infof("User '%s' (%d) should be server admin, promoting", grafanaUser.Login, grafanaUser.ID)
+		} else {
+			klog.Infof("User '%s' (%d) must not be server admin, demoting", grafanaUser.Login, grafanaUser.ID)
+		}
+		err := grafanaClient.UpdateUserPermissions(grafanaUser.ID, isServerAdmin)
+		if err != nil {
+			// This can happen due to race conditions, hence just a warning
+			klog.Warning(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return interruptedError
+		default:
+		}
+	}
+	return nil
+}
+
+// Creates the missing Grafana users who have access to at least one organization, so that their permissions are set up
+// before they log in for the first time. This requires `skip_org_role_sync`, otherwise Grafana resets the permissions
+// on the first OAuth login. Afterwards the snapshot only contains users present in Grafana. The created users are added to
+// the returned Grafana users.
+func provisionUsers(ctx context.Context, config Config, snapshot *IdentitySnapshot, syncedUsers []*User, grafanaUsers []grafana.UserSearch, grafanaClient *GrafanaClient) ([]grafana.UserSearch, error) {
+	grafanaUsernames := make(map[string]bool)
+	for _, user := range syncedUsers {
+		grafanaUsernames[user.Username] = true
+	}
+
+	for _, user := range snapshot.Users {
+		if grafanaUsernames[user.Username] || user.IsDisabled() {
+			continue
+		}
+		if len(snapshot.Memberships[user]) == 0 && !snapshot.IsAdmin(user) && !snapshot.IsSupportUser(user) {
+			continue
+		}
+		klog.Infof("User '%s' is missing, adding", user.Username)
+		// The user gets a random password nobody knows, hence can only log in via OAuth
+		grafanaUser, err := createUser(grafanaClient, user)
+		if err != nil {
+			// for now just continue in case errors happen
+			klog.Error(err)
+			continue
+		}
+		grafanaUsers = append(grafanaUsers, grafana.UserSearch{ID: grafanaUser.ID, Login: grafanaUser.Login, Email: grafanaUser.Email, Name: grafanaUser.Name})
+		if config.UserState != nil {
+			// remembered right away so the user isn't mistaken for a local user even if the next step fails, see ProtectedUsers.ManagedAuthModules
+			config.UserState.state.ProvisionedUsers[grafanaUser.ID] = true
+			err = config.UserState.save()
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = removeUserFromOrgs(grafanaClient, *grafanaUser)
+		if err != nil {
+			// the user exists now, so it is synced like any other user during the next reconciliation
+			klog.Error(err)
+			continue
+		}
+		grafanaUsernames[user.Username] = true
+		// the permissions of the new user must be set even if the source didn't report a change
+		if snapshot.IsAdmin(user) || snapshot.IsSupportUser(user) {
+			snapshot.ChangedOrganizations = nil
+		}
+		for _, membership := range snapshot.Memberships[user] {
+			snapshot.markChanged(membership.Organization.Name)
+		}
 
 		select {
 		case <-ctx.Done():
@@ -72,5 +358,18 @@ func reconcileUsers(ctx context.Context, keycloakUsers []*KeycloakUser, grafanaC
 		}
 	}
 
-	return syncedUsers, nil
+	snapshot.restrictToUsers(grafanaUsernames)
+	return grafanaUsers, nil
+}
+
+func equalUserIds(a map[string]int64, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for sourceId, grafanaId := range a {
+		if otherGrafanaId, ok := b[sourceId]; !ok || otherGrafanaId != grafanaId {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	grafana "github.com/grafana/grafana-api-golang-client"
+	"testing"
+)
+
+func TestFindGrafanaUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		grafanaUsers []grafana.UserSearch
+		knownUserIds map[string]int64
+		users        []*User
+		expected     map[string]int64 // Grafana user ID by User.Id, 0 if there's no match
+	}{
+		{
+			name:         "new user",
+			grafanaUsers: []grafana.UserSearch{{ID: 1, Login: "alice"}},
+			users:        []*User{{Id: "a", Username: "alice"}, {Id: "b", Username: "bob"}},
+			expected:     map[string]int64{"a": 1, "b": 0},
+		},
+		{
+			name:         "rename",
+			grafanaUsers: []grafana.UserSearch{{ID: 1, Login: "alice"}},
+			knownUserIds: map[string]int64{"a": 1},
+			users:        []*User{{Id: "a", Username: "alice2"}},
+			expected:     map[string]int64{"a": 1},
+		},
+		{
+			name:         "rename with the old login taken over by another user",
+			grafanaUsers: []grafana.UserSearch{{ID: 1, Login: "alice"}},
+			knownUserIds: map[string]int64{"a": 1},
+			users:        []*User{{Id: "a", Username: "alice2"}, {Id: "b", Username: "alice"}},
+			expected:     map[string]int64{"a": 1, "b": 0},
+		},
+		{
+			name:         "swap",
+			grafanaUsers: []grafana.UserSearch{{ID: 1, Login: "alice"}, {ID: 2, Login: "bob"}},
+			knownUserIds: map[string]int64{"a": 1, "b": 2},
+			users:        []*User{{Id: "a", Username: "bob"}, {Id: "b", Username: "alice"}},
+			expected:     map[string]int64{"a": 1, "b": 2},
+		},
+		{
+			name:         "deleted and recreated with the same login",
+			grafanaUsers: []grafana.UserSearch{{ID: 1, Login: "alice"}},
+			knownUserIds: map[string]int64{"a": 1},
+			users:        []*User{{Id: "a2", Username: "alice"}},
+			expected:     map[string]int64{"a2": 1},
+		},
+		{
+			name:         "identity source switched",
+			grafanaUsers: []grafana.UserSearch{{ID: 1, Login: "alice"}, {ID: 2, Login: "bob"}},
+			knownUserIds: map[string]int64{"keycloak-a": 1, "keycloak-b": 2},
+			users:        []*User{{Id: "ldap-a", Username: "alice"}, {Id: "ldap-b", Username: "bob"}},
+			expected:     map[string]int64{"ldap-a": 1, "ldap-b": 2},
+		},
+		{
+			name:         "mapped Grafana user deleted",
+			grafanaUsers: []grafana.UserSearch{{ID: 2, Login: "alice"}},
+			knownUserIds: map[string]int64{"a": 1},
+			users:        []*User{{Id: "a", Username: "alice"}},
+			expected:     map[string]int64{"a": 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grafanaUsersByLogin := make(map[string]grafana.UserSearch)
+			grafanaUsersById := make(map[int64]grafana.UserSearch)
+			for _, grafanaUser := range test.grafanaUsers {
+				grafanaUsersByLogin[grafanaUser.Login] = grafanaUser
+				grafanaUsersById[grafanaUser.ID] = grafanaUser
+			}
+			mapping := newUserIdMapping(test.knownUserIds, test.users)
+			for _, user := range test.users {
+				grafanaUser, ok := mapping.findGrafanaUser(user, grafanaUsersByLogin, grafanaUsersById)
+				if !ok {
+					grafanaUser.ID = 0
+				}
+				if grafanaUser.ID != test.expected[user.Id] {
+					t.Errorf("Expected user '%s' to match Grafana user %d, got %d", user.Username, test.expected[user.Id], grafanaUser.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// Grafana organization roles, lowest first
+var grafanaRoles = []string{"Viewer", "Editor", "Admin"}
+
+// Rules which determine the Grafana role of the members of an organization (YAML or JSON file).
+// For every membership of a user the first matching rule determines the role, if a user has several memberships
+// in the same organization the highest role wins. Memberships not matching any rule get DefaultRole.
+type RoleMapping struct {
+	Rules       []RoleMappingRule `json:"rules"`
+	DefaultRole string            `json:"defaultRole"` // "Editor" if empty
+}
+
+type RoleMappingRule struct {
+	Organization string  `json:"organization"` // glob pattern matching the organization name, all organizations if empty
+	Team         *string `json:"team"`         // glob pattern matching the team name, "" for direct members of the organization, all memberships if not set
+	Role         string  `json:"role"`
+}
+
+func LoadRoleMapping(filename string) (*RoleMapping, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	roleMapping := &RoleMapping{}
+	err = yaml.UnmarshalStrict(content, roleMapping)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse role mapping file '%s': %v", filename, err)
+	}
+
+	if roleMapping.DefaultRole == "" {
+		roleMapping.DefaultRole = "Editor"
+	}
+	// roles are stored with their canonical name, that's what getRoleRank() expects
+	defaultRole := normalizeRole(roleMapping.DefaultRole)
+	if defaultRole == "" {
+		return nil, fmt.Errorf("Invalid default role '%s' in role mapping file", roleMapping.DefaultRole)
+	}
+	roleMapping.DefaultRole = defaultRole
+	for i := range roleMapping.Rules {
+		rule := &roleMapping.Rules[i]
+		role := normalizeRole(rule.Role)
+		if role == "" {
+			return nil, fmt.Errorf("Invalid role '%s' in rule %d of role mapping file", rule.Role, i+1)
+		}
+		rule.Role = role
+		// path.Match only reports malformed patterns when matching, hence this check
+		if _, err := path.Match(rule.Organization, ""); err != nil {
+			return nil, fmt.Errorf("Invalid organization pattern '%s' in rule %d of role mapping file", rule.Organization, i+1)
+		}
+		if rule.Team != nil {
+			if _, err := path.Match(*rule.Team, ""); err != nil {
+				return nil, fmt.Errorf("Invalid team pattern '%s' in rule %d of role mapping file", *rule.Team, i+1)
+			}
+		}
+	}
+	return roleMapping, nil
+}
+
+func (this *RoleMappingRule) matches(membership *Membership) bool {
+	if this.Organization != "" {
+		if matched, _ := path.Match(this.Organization, membership.Organization.Name); !matched {
+			return false
+		}
+	}
+	if this.Team != nil {
+		if *this.Team == "" {
+			return membership.Team == ""
+		}
+		if matched, _ := path.Match(*this.Team, membership.Team); !matched || membership.Team == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the role of the user in the organization of the given memberships, which must all be in the same organization.
+// Roles granted by the identity source take precedence over the rules.
+func (this *RoleMapping) getRole(memberships []*Membership) string {
+	role := ""
+	for _, membership := range memberships {
+		membershipRole := membership.Role
+		if membershipRole == "" {
+			membershipRole = this.getRuleRole(membership)
+		}
+		if getRoleRank(membershipRole) > getRoleRank(role) {
+			role = membershipRole
+		}
+	}
+	return role
+}
+
+func (this *RoleMapping) getRuleRole(membership *Membership) string {
+	for _, rule := range this.Rules {
+		if rule.matches(membership) {
+			return rule.Role
+		}
+	}
+	return this.DefaultRole
+}
+
+// Role names are case-insensitive, returns "" for unknown roles
+func normalizeRole(role string) string {
+	for _, r := range grafanaRoles {
+		if strings.EqualFold(r, role) {
+			return r
+		}
+	}
+	return ""
+}
+
+// Returns -1 for unknown roles
+func getRoleRank(role string) int {
+	for i, r := range grafanaRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// The role itself and all lower roles, highest first. The operator accepts lower roles than the one granted, so manual demotions in Grafana stick.
+func getPermittedRoles(role string) []string {
+	permittedRoles := make([]string, 0, len(grafanaRoles))
+	for i := getRoleRank(role); i >= 0; i-- {
+		permittedRoles = append(permittedRoles, grafanaRoles[i])
+	}
+	return permittedRoles
+}
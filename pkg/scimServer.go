@@ -0,0 +1,1084 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scimUserSchema      = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema     = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema     = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSpConfigSchema  = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType     = "application/scim+json"
+	scimDefaultPageSize = 100
+
+	// The initial push of the identity provider is considered complete once it hasn't sent any changes for this long
+	scimInitialPushQuietPeriod = 5 * time.Minute
+
+	// Changes are written to the state file at most this often. Rewriting the whole file for every single change would
+	// be far too slow during an initial push of thousands of users.
+	scimSaveInterval = 2 * time.Second
+)
+
+// Settings of the SCIM server. Groups named "[OrganizationsRoot]/[ORGNAME]" are organizations,
+// groups named "[OrganizationsRoot]/[ORGNAME]/[TEAMNAME]" are teams.
+type ScimConfig struct {
+	ListenAddress     string
+	Token             string // Bearer token the identity provider must send
+	OrganizationsRoot string
+	AdminGroup        string // Name of the group whose members have "Admin" permissions on all organizations
+	StateFile         string // Users and groups are persisted to this file so they survive restarts, mandatory
+}
+
+type ScimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+type ScimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type ScimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// Boolean which also accepts the strings "True" and "False", as sent by Entra ID
+type ScimBool bool
+
+func (this *ScimBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*this = ScimBool(v)
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid boolean '%s'", v)
+		}
+		*this = ScimBool(b)
+	default:
+		return fmt.Errorf("Invalid boolean %s", string(data))
+	}
+	return nil
+}
+
+type ScimUser struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	Name        *ScimName        `json:"name,omitempty"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []ScimMultiValue `json:"emails,omitempty"`
+	Active      *ScimBool        `json:"active,omitempty"`
+	Meta        ScimMeta         `json:"meta"`
+}
+
+type ScimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []ScimMultiValue `json:"members,omitempty"`
+	Meta        ScimMeta         `json:"meta"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimState struct {
+	Users      map[string]*ScimUser  `json:"users"`
+	Groups     map[string]*ScimGroup `json:"groups"`
+	Incomplete bool                  `json:"incomplete,omitempty"` // true until the initial push is complete
+}
+
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (this *scimError) Error() string {
+	return this.detail
+}
+
+// SCIM 2.0 (RFC 7643/7644) server which receives users and groups from an identity provider. Implements IdentitySource.
+type ScimServer struct {
+	config ScimConfig
+	lock   sync.RWMutex
+	state  scimState
+	ready  bool // true as soon as the initial push is complete, possibly before the last restart
+	dirty  bool // true if the state has changed since it was last written to the state file
+
+	// Time of the last change received before the store became ready
+	lastChange time.Time
+
+	saveLock sync.Mutex // Serializes writes of the state file
+}
+
+func NewScimServer(config ScimConfig) (*ScimServer, error) {
+	if config.Token == "" {
+		return nil, errors.New("SCIM token missing")
+	}
+	// identity providers only push changes after the initial push, a restart without state would lose everything else
+	if config.StateFile == "" {
+		return nil, errors.New("SCIM state file missing")
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = ":8080"
+	}
+	if config.OrganizationsRoot == "" {
+		config.OrganizationsRoot = "organizations"
+	}
+	config.OrganizationsRoot = strings.Trim(config.OrganizationsRoot, "/")
+
+	server := &ScimServer{
+		config: config,
+		state: scimState{
+			Users:  make(map[string]*ScimUser),
+			Groups: make(map[string]*ScimGroup),
+		},
+	}
+
+	content, err := os.ReadFile(config.StateFile)
+	if err == nil {
+		err = json.Unmarshal(content, &server.state)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse SCIM state file '%s': %v", config.StateFile, err)
+		}
+		server.ready = !server.state.Incomplete
+		if !server.ready {
+			// the quiet period starts over, the changes received before the restart count as if they had just been received
+			server.lastChange = time.Now()
+		}
+		klog.Infof("Loaded %d users and %d groups from SCIM state file", len(server.state.Users), len(server.state.Groups))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// Serve the SCIM API until the context is cancelled
+func (this *ScimServer) Start(ctx context.Context) {
+	server := &http.Server{
+		Addr:              this.config.ListenAddress,
+		Handler:           this.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+	}
+	go func() {
+		klog.Infof("SCIM server listening on %s", this.config.ListenAddress)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			klog.Errorf("SCIM server failed: %v", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(scimSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := this.flush()
+				if err != nil {
+					klog.Errorf("Could not write SCIM state file: %v", err)
+				}
+			case <-ctx.Done():
+				server.Close()
+				err := this.flush()
+				if err != nil {
+					klog.Errorf("Could not write SCIM state file: %v", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (this *ScimServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scim/v2/ServiceProviderConfig", this.authenticated(this.handleServiceProviderConfig))
+	mux.HandleFunc("/scim/v2/Users", this.authenticated(this.handleUsers))
+	mux.HandleFunc("/scim/v2/Users/", this.authenticated(this.handleUser))
+	mux.HandleFunc("/scim/v2/Groups", this.authenticated(this.handleGroups))
+	mux.HandleFunc("/scim/v2/Groups/", this.authenticated(this.handleGroup))
+	return mux
+}
+
+func (this *ScimServer) authenticated(handler func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+this.config.Token)) != 1 {
+			writeScimError(w, &scimError{status: http.StatusUnauthorized, detail: "Invalid token"})
+			return
+		}
+		err := handler(w, r)
+		if err != nil {
+			writeScimError(w, err)
+		}
+	}
+}
+
+func writeScimError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	scimType := ""
+	var se *scimError
+	if errors.As(err, &se) {
+		status = se.status
+		scimType = se.scimType
+	} else {
+		klog.Error(err)
+	}
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  err.Error(),
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeScimJson(w, status, body)
+}
+
+func writeScimJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func readScimJson(r *http.Request, target interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, target)
+	if err != nil {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()}
+	}
+	return nil
+}
+
+// Record a change of the state, which is persisted by the next flush(). The caller must hold the write lock.
+func (this *ScimServer) save() {
+	if !this.ready {
+		this.ready = this.initialPushComplete()
+		this.lastChange = time.Now()
+		this.state.Incomplete = !this.ready
+	}
+	this.dirty = true
+}
+
+// Write the state to the state file if it has changed since the last call
+func (this *ScimServer) flush() error {
+	this.saveLock.Lock()
+	defer this.saveLock.Unlock()
+
+	this.lock.Lock()
+	if !this.dirty {
+		this.lock.Unlock()
+		return nil
+	}
+	content, err := json.Marshal(this.state)
+	this.dirty = err != nil
+	this.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpFile := this.config.StateFile + ".tmp"
+	err = os.WriteFile(tmpFile, content, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, this.config.StateFile)
+	}
+	if err != nil {
+		// try again next time
+		this.lock.Lock()
+		this.dirty = true
+		this.lock.Unlock()
+	}
+	return err
+}
+
+func (this *ScimServer) handleServiceProviderConfig(w http.ResponseWriter, r *http.Request) error {
+	writeScimJson(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSpConfigSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimDefaultPageSize},
+		"changePassword": map[string]bool{"supported": false},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Authentication with a static bearer token",
+		}},
+	})
+	return nil
+}
+
+// Only filters of the form 'attribute eq "value"' are supported, that's what identity providers use to look up existing resources
+var scimFilterRegexp = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+func parseScimFilter(filter string) (string, string, error) {
+	if filter == "" {
+		return "", "", nil
+	}
+	matches := scimFilterRegexp.FindStringSubmatch(filter)
+	if matches == nil {
+		return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "Unsupported filter: " + filter}
+	}
+	value, err := strconv.Unquote(`"` + matches[2] + `"`)
+	if err != nil {
+		return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "Invalid filter value: " + matches[2]}
+	}
+	return strings.ToLower(matches[1]), value, nil
+}
+
+func writeScimList[T any](w http.ResponseWriter, r *http.Request, resources []T) error {
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 {
+		count = scimDefaultPageSize
+	}
+	total := len(resources)
+	first := startIndex - 1
+	if first > total {
+		first = total
+	}
+	// clamped before adding, a huge count would overflow
+	if count > total-first {
+		count = total - first
+	}
+	last := first + count
+	writeScimJson(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": last - first,
+		"Resources":    resources[first:last],
+	})
+	return nil
+}
+
+func scimNow() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func (this *ScimServer) handleUsers(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		attribute, value, err := parseScimFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			return err
+		}
+		this.lock.RLock()
+		defer this.lock.RUnlock()
+		users := make([]*ScimUser, 0)
+		for _, user := range this.state.Users {
+			switch attribute {
+			case "":
+			case "username":
+				if !strings.EqualFold(user.UserName, value) {
+					continue
+				}
+			case "externalid":
+				if user.ExternalId != value {
+					continue
+				}
+			case "id":
+				if user.Id != value {
+					continue
+				}
+			case "emails.value", "emails":
+				found := false
+				for _, email := range user.Emails {
+					found = found || strings.EqualFold(email.Value, value)
+				}
+				if !found {
+					continue
+				}
+			default:
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "Unsupported filter attribute: " + attribute}
+			}
+			users = append(users, user)
+		}
+		// sorted by ID within the same second, otherwise the order of the map would make paging skip or repeat users
+		sort.SliceStable(users, func(i, j int) bool {
+			if users[i].Meta.Created != users[j].Meta.Created {
+				return users[i].Meta.Created < users[j].Meta.Created
+			}
+			return users[i].Id < users[j].Id
+		})
+		return writeScimList(w, r, users)
+	case http.MethodPost:
+		user := &ScimUser{}
+		err := readScimJson(r, user)
+		if err != nil {
+			return err
+		}
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		user.Id = uuid.NewString()
+		user.Meta.Created = scimNow()
+		err = this.storeUser(user)
+		if err != nil {
+			return err
+		}
+		klog.Infof("SCIM: user '%s' created", user.UserName)
+		writeScimJson(w, http.StatusCreated, user)
+		return nil
+	}
+	return &scimError{status: http.StatusMethodNotAllowed, detail: "Method not allowed"}
+}
+
+// Validate and store the user. The caller must hold the write lock.
+func (this *ScimServer) storeUser(user *ScimUser) error {
+	if user.UserName == "" {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "userName is required"}
+	}
+	for _, other := range this.state.Users {
+		if other.Id != user.Id && strings.EqualFold(other.UserName, user.UserName) {
+			return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "userName already exists"}
+		}
+	}
+	user.Schemas = []string{scimUserSchema}
+	user.Meta.ResourceType = "User"
+	user.Meta.LastModified = scimNow()
+	user.Meta.Location = "/scim/v2/Users/" + user.Id
+	this.state.Users[user.Id] = user
+	this.save()
+	return nil
+}
+
+func (this *ScimServer) handleUser(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Users/")
+
+	if r.Method == http.MethodGet {
+		this.lock.RLock()
+		defer this.lock.RUnlock()
+	} else {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+	}
+
+	existing, ok := this.state.Users[id]
+	if !ok {
+		return &scimError{status: http.StatusNotFound, detail: "User not found"}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeScimJson(w, http.StatusOK, existing)
+		return nil
+	case http.MethodPut:
+		user := &ScimUser{}
+		err := readScimJson(r, user)
+		if err != nil {
+			return err
+		}
+		user.Id = existing.Id
+		user.Meta = existing.Meta
+		err = this.storeUser(user)
+		if err != nil {
+			return err
+		}
+		klog.Infof("SCIM: user '%s' replaced", user.UserName)
+		writeScimJson(w, http.StatusOK, user)
+		return nil
+	case http.MethodPatch:
+		patch := &scimPatchRequest{}
+		err := readScimJson(r, patch)
+		if err != nil {
+			return err
+		}
+		user, err := patchScimUser(existing, patch.Operations)
+		if err != nil {
+			return err
+		}
+		err = this.storeUser(user)
+		if err != nil {
+			return err
+		}
+		klog.Infof("SCIM: user '%s' modified", user.UserName)
+		writeScimJson(w, http.StatusOK, user)
+		return nil
+	case http.MethodDelete:
+		delete(this.state.Users, id)
+		for _, group := range this.state.Groups {
+			group.Members = removeScimMembers(group.Members, map[string]bool{id: true})
+		}
+		this.save()
+		klog.Infof("SCIM: user '%s' deleted", existing.UserName)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return &scimError{status: http.StatusMethodNotAllowed, detail: "Method not allowed"}
+}
+
+// Users are patched on their JSON representation, which supports simple attribute paths like "active" or "name.givenName"
+func patchScimUser(user *ScimUser, operations []scimPatchOperation) (*ScimUser, error) {
+	content, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	userMap := make(map[string]interface{})
+	err = json.Unmarshal(content, &userMap)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, operation := range operations {
+		var value interface{}
+		if len(operation.Value) > 0 {
+			err = json.Unmarshal(operation.Value, &value)
+			if err != nil {
+				return nil, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+			}
+		}
+
+		if operation.Path == "" {
+			values, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Value must be an object if no path is given"}
+			}
+			for path, v := range values {
+				err = patchScimAttribute(userMap, strings.ToLower(operation.Op), path, v)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			err = patchScimAttribute(userMap, strings.ToLower(operation.Op), operation.Path, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	content, err = json.Marshal(userMap)
+	if err != nil {
+		return nil, err
+	}
+	patched := &ScimUser{}
+	err = json.Unmarshal(content, patched)
+	if err != nil {
+		return nil, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+	}
+	patched.Id = user.Id
+	patched.Meta = user.Meta
+	return patched, nil
+}
+
+// Attribute names are case-insensitive in SCIM, hence we look up the existing key
+func findScimAttribute(object map[string]interface{}, name string) string {
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// Filtered paths of the form 'attribute[subattribute eq "value"]' or 'attribute[subattribute eq "value"].subattribute' on
+// multi-valued attributes, e.g. 'emails[type eq "work"].value' as sent by Entra ID
+var scimFilteredPathRegexp = regexp.MustCompile(`^([A-Za-z]+)\[\s*([A-Za-z]+)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*\](?:\.([A-Za-z]+))?$`)
+
+func patchScimAttribute(object map[string]interface{}, op string, path string, value interface{}) error {
+	path = strings.TrimPrefix(path, scimUserSchema+":")
+	if strings.ContainsAny(path, "[]") {
+		matches := scimFilteredPathRegexp.FindStringSubmatch(path)
+		if matches == nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "Unsupported filter in path: " + path}
+		}
+		filterValue, err := strconv.Unquote(`"` + matches[3] + `"`)
+		if err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "Invalid filter value: " + matches[3]}
+		}
+		return patchScimFilteredAttribute(object, op, matches[1], matches[2], filterValue, matches[4], value)
+	}
+	elements := strings.SplitN(path, ".", 2)
+	key := findScimAttribute(object, elements[0])
+	if len(elements) == 2 {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		return patchScimAttribute(child, op, elements[1], value)
+	}
+
+	switch op {
+	case "add":
+		existing, isList := object[key].([]interface{})
+		values, valueIsList := value.([]interface{})
+		if isList && valueIsList {
+			object[key] = append(existing, values...)
+		} else {
+			object[key] = value
+		}
+	case "replace":
+		object[key] = value
+	case "remove":
+		delete(object, key)
+	default:
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "Unknown patch operation: " + op}
+	}
+	return nil
+}
+
+// Patch the values of a multi-valued attribute matching the filter. If subAttribute is empty the matching values
+// themselves are replaced or removed. "add" and "replace" add a new value if none matches, like identity providers expect.
+func patchScimFilteredAttribute(object map[string]interface{}, op string, attribute string, filterAttribute string, filterValue string, subAttribute string, value interface{}) error {
+	if op != "add" && op != "replace" && op != "remove" {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "Unknown patch operation: " + op}
+	}
+	key := findScimAttribute(object, attribute)
+	existing, _ := object[key].([]interface{})
+
+	var patched []interface{}
+	found := false
+	for _, element := range existing {
+		elementMap, ok := element.(map[string]interface{})
+		if !ok {
+			patched = append(patched, element)
+			continue
+		}
+		elementValue, _ := elementMap[findScimAttribute(elementMap, filterAttribute)].(string)
+		if !strings.EqualFold(elementValue, filterValue) {
+			patched = append(patched, element)
+			continue
+		}
+		found = true
+		switch {
+		case subAttribute == "" && op == "remove":
+		case subAttribute == "":
+			patched = append(patched, value)
+		case op == "remove":
+			delete(elementMap, findScimAttribute(elementMap, subAttribute))
+			patched = append(patched, elementMap)
+		default:
+			elementMap[findScimAttribute(elementMap, subAttribute)] = value
+			patched = append(patched, elementMap)
+		}
+	}
+
+	if !found && op != "remove" {
+		if subAttribute == "" {
+			patched = append(patched, value)
+		} else {
+			patched = append(patched, map[string]interface{}{filterAttribute: filterValue, subAttribute: value})
+		}
+	}
+
+	if len(patched) == 0 {
+		delete(object, key)
+	} else {
+		object[key] = patched
+	}
+	return nil
+}
+
+func (this *ScimServer) handleGroups(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		attribute, value, err := parseScimFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			return err
+		}
+		excludeMembers := strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+		this.lock.RLock()
+		defer this.lock.RUnlock()
+		groups := make([]*ScimGroup, 0)
+		for _, group := range this.state.Groups {
+			switch attribute {
+			case "":
+			case "displayname":
+				if !strings.EqualFold(group.DisplayName, value) {
+					continue
+				}
+			case "externalid":
+				if group.ExternalId != value {
+					continue
+				}
+			case "id":
+				if group.Id != value {
+					continue
+				}
+			default:
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "Unsupported filter attribute: " + attribute}
+			}
+			if excludeMembers {
+				withoutMembers := *group
+				withoutMembers.Members = nil
+				group = &withoutMembers
+			}
+			groups = append(groups, group)
+		}
+		sort.SliceStable(groups, func(i, j int) bool {
+			if groups[i].Meta.Created != groups[j].Meta.Created {
+				return groups[i].Meta.Created < groups[j].Meta.Created
+			}
+			return groups[i].Id < groups[j].Id
+		})
+		return writeScimList(w, r, groups)
+	case http.MethodPost:
+		group := &ScimGroup{}
+		err := readScimJson(r, group)
+		if err != nil {
+			return err
+		}
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		group.Id = uuid.NewString()
+		group.Meta.Created = scimNow()
+		err = this.storeGroup(group)
+		if err != nil {
+			return err
+		}
+		klog.Infof("SCIM: group '%s' created", group.DisplayName)
+		writeScimJson(w, http.StatusCreated, group)
+		return nil
+	}
+	return &scimError{status: http.StatusMethodNotAllowed, detail: "Method not allowed"}
+}
+
+// Validate and store the group. The caller must hold the write lock.
+func (this *ScimServer) storeGroup(group *ScimGroup) error {
+	if group.DisplayName == "" {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "displayName is required"}
+	}
+	for _, other := range this.state.Groups {
+		if other.Id != group.Id && other.DisplayName == group.DisplayName {
+			return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "displayName already exists"}
+		}
+	}
+	group.Schemas = []string{scimGroupSchema}
+	group.Meta.ResourceType = "Group"
+	group.Meta.LastModified = scimNow()
+	group.Meta.Location = "/scim/v2/Groups/" + group.Id
+	this.state.Groups[group.Id] = group
+	this.save()
+	return nil
+}
+
+func (this *ScimServer) handleGroup(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Groups/")
+
+	if r.Method == http.MethodGet {
+		this.lock.RLock()
+		defer this.lock.RUnlock()
+	} else {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+	}
+
+	existing, ok := this.state.Groups[id]
+	if !ok {
+		return &scimError{status: http.StatusNotFound, detail: "Group not found"}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeScimJson(w, http.StatusOK, existing)
+		return nil
+	case http.MethodPut:
+		group := &ScimGroup{}
+		err := readScimJson(r, group)
+		if err != nil {
+			return err
+		}
+		group.Id = existing.Id
+		group.Meta = existing.Meta
+		err = this.storeGroup(group)
+		if err != nil {
+			return err
+		}
+		klog.Infof("SCIM: group '%s' replaced", group.DisplayName)
+		writeScimJson(w, http.StatusOK, group)
+		return nil
+	case http.MethodPatch:
+		patch := &scimPatchRequest{}
+		err := readScimJson(r, patch)
+		if err != nil {
+			return err
+		}
+		group := *existing
+		group.Members = append([]ScimMultiValue{}, existing.Members...)
+		for _, operation := range patch.Operations {
+			err = patchScimGroup(&group, operation)
+			if err != nil {
+				return err
+			}
+		}
+		err = this.storeGroup(&group)
+		if err != nil {
+			return err
+		}
+		klog.Infof("SCIM: group '%s' modified", group.DisplayName)
+		writeScimJson(w, http.StatusOK, &group)
+		return nil
+	case http.MethodDelete:
+		delete(this.state.Groups, id)
+		this.save()
+		klog.Infof("SCIM: group '%s' deleted", existing.DisplayName)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return &scimError{status: http.StatusMethodNotAllowed, detail: "Method not allowed"}
+}
+
+var scimMemberPathRegexp = regexp.MustCompile(`^(?i)members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+func patchScimGroup(group *ScimGroup, operation scimPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	path := strings.TrimPrefix(operation.Path, scimGroupSchema+":")
+
+	// Some identity providers send "replace" without path and an object containing the attributes
+	if path == "" {
+		values := make(map[string]json.RawMessage)
+		err := json.Unmarshal(operation.Value, &values)
+		if err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+		}
+		for key, value := range values {
+			err = patchScimGroup(group, scimPatchOperation{Op: operation.Op, Path: key, Value: value})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if matches := scimMemberPathRegexp.FindStringSubmatch(path); matches != nil {
+		if op != "remove" {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "Member filters are only supported for 'remove'"}
+		}
+		group.Members = removeScimMembers(group.Members, map[string]bool{matches[1]: true})
+		return nil
+	}
+
+	switch strings.ToLower(path) {
+	case "displayname":
+		if op == "remove" {
+			return &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: "displayName is required"}
+		}
+		return json.Unmarshal(operation.Value, &group.DisplayName)
+	case "externalid":
+		if op == "remove" {
+			group.ExternalId = ""
+			return nil
+		}
+		return json.Unmarshal(operation.Value, &group.ExternalId)
+	case "members":
+		var members []ScimMultiValue
+		if len(operation.Value) > 0 {
+			err := json.Unmarshal(operation.Value, &members)
+			if err != nil {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+			}
+		}
+		switch op {
+		case "add":
+			ids := make(map[string]bool)
+			for _, member := range members {
+				ids[member.Value] = true
+			}
+			group.Members = append(removeScimMembers(group.Members, ids), members...)
+		case "replace":
+			group.Members = members
+		case "remove":
+			if len(members) == 0 {
+				group.Members = nil
+			} else {
+				ids := make(map[string]bool)
+				for _, member := range members {
+					ids[member.Value] = true
+				}
+				group.Members = removeScimMembers(group.Members, ids)
+			}
+		default:
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "Unknown patch operation: " + op}
+		}
+		return nil
+	}
+	return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "Unsupported path: " + operation.Path}
+}
+
+func removeScimMembers(members []ScimMultiValue, ids map[string]bool) []ScimMultiValue {
+	var remaining []ScimMultiValue
+	for _, member := range members {
+		if !ids[member.Value] {
+			remaining = append(remaining, member)
+		}
+	}
+	return remaining
+}
+
+func (this *ScimUser) isActive() bool {
+	return this.Active == nil || bool(*this.Active)
+}
+
+func (this *ScimUser) getEmail() string {
+	for _, email := range this.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(this.Emails) > 0 {
+		return this.Emails[0].Value
+	}
+	return ""
+}
+
+// We only know that the identity provider has finished its initial push when it stops sending changes. The caller must
+// hold the read lock.
+func (this *ScimServer) initialPushComplete() bool {
+	return !this.lastChange.IsZero() && time.Since(this.lastChange) >= scimInitialPushQuietPeriod
+}
+
+// ScimServer implements IdentitySource
+
+func (this *ScimServer) GetUsers(ctx context.Context) ([]*User, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// Without this check partial data would remove all other organizations and users from Grafana
+	if !this.ready {
+		if !this.initialPushComplete() {
+			return nil, errors.New("Initial SCIM push not complete yet")
+		}
+		// persist the readiness, otherwise we'd wait for another push after a restart
+		this.ready = true
+		this.state.Incomplete = false
+		this.save()
+		klog.Infof("Initial SCIM push complete")
+	}
+
+	users := make([]*User, 0, len(this.state.Users))
+	for _, scimUser := range this.state.Users {
+		disabled := !scimUser.isActive()
+		user := &User{
+			Id:       scimUser.Id,
+			Username: scimUser.UserName,
+			Email:    scimUser.getEmail(),
+			Disabled: &disabled,
+		}
+		if scimUser.Name != nil {
+			user.FirstName = scimUser.Name.GivenName
+			user.LastName = scimUser.Name.FamilyName
+		}
+		if user.FirstName == "" && user.LastName == "" {
+			user.FirstName = scimUser.DisplayName
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (this *ScimServer) GetSnapshot(ctx context.Context, users []*User) (*IdentitySnapshot, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	snapshot := &IdentitySnapshot{
+		Users:       users,
+		Memberships: make(map[*User][]*Membership),
+	}
+
+	// inactive users don't get any permissions
+	usersMap := make(map[string]*User)
+	for _, user := range users {
+		if scimUser, ok := this.state.Users[user.Id]; ok && scimUser.isActive() {
+			usersMap[user.Id] = user
+		}
+	}
+
+	organizations := make(map[string]*Organization)
+	var teamGroups []*ScimGroup
+	for _, group := range this.state.Groups {
+		if group.DisplayName == this.config.AdminGroup {
+			for _, member := range group.Members {
+				if user, ok := usersMap[member.Value]; ok {
+					snapshot.Admins = append(snapshot.Admins, user)
+				}
+			}
+		}
+
+		pathElements := strings.Split(strings.Trim(group.DisplayName, "/"), "/")
+		if len(pathElements) < 2 || pathElements[0] != this.config.OrganizationsRoot {
+			continue
+		}
+		if len(pathElements) > 2 {
+			teamGroups = append(teamGroups, group)
+			continue
+		}
+		organization := &Organization{Name: pathElements[1]}
+		organizations[organization.Name] = organization
+		snapshot.Organizations = append(snapshot.Organizations, organization)
+		for _, member := range group.Members {
+			if user, ok := usersMap[member.Value]; ok {
+				snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization})
+			}
+		}
+	}
+
+	for _, group := range teamGroups {
+		pathElements := strings.Split(strings.Trim(group.DisplayName, "/"), "/")
+		organization, ok := organizations[pathElements[1]]
+		if !ok {
+			continue
+		}
+		organization.Teams = append(organization.Teams, &Team{Name: pathElements[2]})
+		for _, member := range group.Members {
+			if user, ok := usersMap[member.Value]; ok {
+				snapshot.Memberships[user] = append(snapshot.Memberships[user], &Membership{Organization: organization, Team: pathElements[2]})
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (this *ScimServer) CloseIdleConnections() {
+}
@@ -0,0 +1,259 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScimToken = "secret"
+
+func newTestScimServer(t *testing.T) (*ScimServer, *httptest.Server) {
+	server, err := NewScimServer(ScimConfig{Token: testScimToken, AdminGroup: "admins", StateFile: filepath.Join(t.TempDir(), "scim.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server.handler())
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+// Send a request to the SCIM server and decode the response into result, unless it is nil
+func testScimRequest(t *testing.T, httpServer *httptest.Server, method string, path string, body string, expectedStatus int, result interface{}) {
+	req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testScimToken)
+	req.Header.Set("Content-Type", scimContentType)
+	r, err := httpServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != expectedStatus {
+		t.Fatalf("%s %s: expected status %d, got %d", method, path, expectedStatus, r.StatusCode)
+	}
+	if result != nil {
+		err = json.NewDecoder(r.Body).Decode(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type testScimUserList struct {
+	TotalResults int         `json:"totalResults"`
+	Resources    []*ScimUser `json:"Resources"`
+}
+
+type testScimGroupList struct {
+	TotalResults int          `json:"totalResults"`
+	Resources    []*ScimGroup `json:"Resources"`
+}
+
+func TestScimServerRejectsInvalidToken(t *testing.T) {
+	_, httpServer := newTestScimServer(t)
+	req, _ := http.NewRequest(http.MethodGet, httpServer.URL+"/scim/v2/Users", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	r, err := httpServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", r.StatusCode)
+	}
+}
+
+func TestScimServerUsers(t *testing.T) {
+	_, httpServer := newTestScimServer(t)
+
+	alice := &ScimUser{}
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Users", `{"userName":"alice","name":{"givenName":"Alice"},"emails":[{"value":"alice@example.com","type":"work"}],"active":true}`, http.StatusCreated, alice)
+	if alice.Id == "" || alice.Meta.Location != "/scim/v2/Users/"+alice.Id {
+		t.Fatalf("Unexpected user: %+v", alice)
+	}
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Users", `{"userName":"Alice"}`, http.StatusConflict, nil)
+
+	list := &testScimUserList{}
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Users?filter="+`userName%20eq%20%22ALICE%22`, "", http.StatusOK, list)
+	if list.TotalResults != 1 || list.Resources[0].Id != alice.Id {
+		t.Errorf("Expected to find alice by userName, got %+v", list)
+	}
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Users?filter="+`emails.value%20eq%20%22nobody@example.com%22`, "", http.StatusOK, list)
+	if list.TotalResults != 0 {
+		t.Errorf("Expected no users, got %+v", list)
+	}
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Users?filter="+`title%20eq%20%22x%22`, "", http.StatusBadRequest, nil)
+
+	// operations as sent by Entra ID
+	patched := &ScimUser{}
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Users/"+alice.Id, `{"schemas":["`+scimPatchSchema+`"],"Operations":[
+		{"op":"Replace","path":"active","value":"False"},
+		{"op":"replace","path":"emails[type eq \"work\"].value","value":"alice@example.org"},
+		{"op":"add","path":"name.familyName","value":"Smith"}]}`, http.StatusOK, patched)
+	if patched.isActive() || patched.getEmail() != "alice@example.org" || patched.Name.GivenName != "Alice" || patched.Name.FamilyName != "Smith" {
+		t.Errorf("Unexpected patched user: %+v", patched)
+	}
+
+	// without path the value contains the attributes
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Users/"+alice.Id, `{"Operations":[{"op":"replace","value":{"active":true,"displayName":"Alice S."}}]}`, http.StatusOK, patched)
+	if !patched.isActive() || patched.DisplayName != "Alice S." || patched.Id != alice.Id {
+		t.Errorf("Unexpected patched user: %+v", patched)
+	}
+
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Users/"+alice.Id, `{"Operations":[{"op":"move","path":"active","value":true}]}`, http.StatusBadRequest, nil)
+	testScimRequest(t, httpServer, http.MethodDelete, "/scim/v2/Users/"+alice.Id, "", http.StatusNoContent, nil)
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Users/"+alice.Id, "", http.StatusNotFound, nil)
+}
+
+func TestScimServerGroups(t *testing.T) {
+	server, httpServer := newTestScimServer(t)
+
+	alice := &ScimUser{}
+	bob := &ScimUser{}
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Users", `{"userName":"alice"}`, http.StatusCreated, alice)
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Users", `{"userName":"bob","active":"False"}`, http.StatusCreated, bob)
+
+	acme := &ScimGroup{}
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Groups", `{"displayName":"organizations/acme","members":[{"value":"`+alice.Id+`"}]}`, http.StatusCreated, acme)
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Groups/"+acme.Id, `{"Operations":[{"op":"add","path":"members","value":[{"value":"`+bob.Id+`"}]}]}`, http.StatusOK, acme)
+	if len(acme.Members) != 2 {
+		t.Fatalf("Expected 2 members, got %+v", acme.Members)
+	}
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Groups/"+acme.Id, `{"Operations":[{"op":"remove","path":"members[value eq \"`+alice.Id+`\"]"}]}`, http.StatusOK, acme)
+	if len(acme.Members) != 1 || acme.Members[0].Value != bob.Id {
+		t.Fatalf("Expected bob to be the only member, got %+v", acme.Members)
+	}
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Groups/"+acme.Id, `{"Operations":[{"op":"add","path":"members[value eq \"`+alice.Id+`\"]"}]}`, http.StatusBadRequest, nil)
+	testScimRequest(t, httpServer, http.MethodPatch, "/scim/v2/Groups/"+acme.Id, `{"Operations":[{"op":"replace","value":{"members":[{"value":"`+alice.Id+`"},{"value":"`+bob.Id+`"}]}}]}`, http.StatusOK, acme)
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Groups", `{"displayName":"organizations/acme/ops","members":[{"value":"`+alice.Id+`"}]}`, http.StatusCreated, nil)
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Groups", `{"displayName":"admins","members":[{"value":"`+bob.Id+`"}]}`, http.StatusCreated, nil)
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Groups", `{"displayName":"admins"}`, http.StatusConflict, nil)
+
+	// displayName isn't case-sensitive
+	list := &testScimGroupList{}
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Groups?excludedAttributes=members&filter="+`displayName%20eq%20%22Organizations/ACME%22`, "", http.StatusOK, list)
+	if list.TotalResults != 1 || list.Resources[0].Id != acme.Id || len(list.Resources[0].Members) != 0 {
+		t.Errorf("Expected acme without members, got %+v", list)
+	}
+
+	// the users are only returned once the initial push is complete
+	_, err := server.GetUsers(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error during the initial push")
+	}
+	server.lastChange = time.Now().Add(-scimInitialPushQuietPeriod)
+	users, err := server.GetUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := server.GetSnapshot(context.Background(), users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob is inactive and doesn't get any permissions
+	expectedMemberships := []string{"alice@acme/", "alice@acme/ops"}
+	if memberships := getTestMemberships(snapshot); strings.Join(memberships, " ") != strings.Join(expectedMemberships, " ") {
+		t.Errorf("Expected memberships %v, got %v", expectedMemberships, memberships)
+	}
+	if len(snapshot.Admins) != 0 {
+		t.Errorf("Expected no admins, got %v", snapshot.Admins)
+	}
+
+	// deleted users are removed from the groups
+	testScimRequest(t, httpServer, http.MethodDelete, "/scim/v2/Users/"+alice.Id, "", http.StatusNoContent, nil)
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Groups/"+acme.Id, "", http.StatusOK, acme)
+	if len(acme.Members) != 1 || acme.Members[0].Value != bob.Id {
+		t.Errorf("Expected bob to be the only member, got %+v", acme.Members)
+	}
+}
+
+func TestScimServerPaging(t *testing.T) {
+	_, httpServer := newTestScimServer(t)
+
+	// users created within the same second must still be returned in a stable order
+	for _, name := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Users", `{"userName":"`+name+`"}`, http.StatusCreated, nil)
+	}
+	seen := make(map[string]bool)
+	for startIndex := 1; startIndex <= 5; startIndex += 2 {
+		list := &testScimUserList{}
+		testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Users?count=2&startIndex="+strconv.Itoa(startIndex), "", http.StatusOK, list)
+		if list.TotalResults != 5 {
+			t.Fatalf("Expected 5 users in total, got %d", list.TotalResults)
+		}
+		for _, user := range list.Resources {
+			if seen[user.Id] {
+				t.Errorf("User '%s' returned twice", user.UserName)
+			}
+			seen[user.Id] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected 5 users, got %d", len(seen))
+	}
+
+	// must not overflow
+	list := &testScimUserList{}
+	testScimRequest(t, httpServer, http.MethodGet, "/scim/v2/Users?startIndex=2&count=9223372036854775807", "", http.StatusOK, list)
+	if list.TotalResults != 5 || len(list.Resources) != 4 {
+		t.Errorf("Expected the last 4 of 5 users, got %d of %d", len(list.Resources), list.TotalResults)
+	}
+}
+
+func TestScimServerState(t *testing.T) {
+	server, httpServer := newTestScimServer(t)
+
+	testScimRequest(t, httpServer, http.MethodPost, "/scim/v2/Users", `{"userName":"alice"}`, http.StatusCreated, nil)
+	err := server.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart during the initial push waits for the quiet period again
+	restarted, err := NewScimServer(server.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restarted.GetUsers(context.Background()); err == nil {
+		t.Fatal("Expected an error during the initial push")
+	}
+
+	// once the initial push is complete that is persisted
+	restarted.lastChange = time.Now().Add(-scimInitialPushQuietPeriod)
+	if _, err = restarted.GetUsers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err = restarted.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(server.config.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "incomplete") {
+		t.Errorf("Expected the state file to be complete: %s", content)
+	}
+
+	restarted, err = NewScimServer(server.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := restarted.GetUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "alice" {
+		t.Errorf("Expected alice to be loaded from the state file, got %v", users)
+	}
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	grafana "github.com/grafana/grafana-api-golang-client"
+	"k8s.io/klog/v2"
+	"os"
+	"time"
+)
+
+// State of the Grafana users which must survive restarts of the operator. It's persisted to a JSON file if one is configured, otherwise it's only kept in memory.
+type UserState struct {
+	filename string
+	state    userState
+}
+
+type userState struct {
+	MissingUsers map[int64]*MissingUser `json:"missingUsers"` // Grafana users not found in the identity source, key is the Grafana user ID
+	UserIds      map[string]int64       `json:"userIds"`      // Grafana user IDs of the users of the identity source, key is User.Id
+
+	// Grafana users created by the operator which haven't logged in yet, key is the Grafana user ID
+	ProvisionedUsers map[int64]bool `json:"provisionedUsers"`
+}
+
+type MissingUser struct {
+	Login        string    `json:"login"`
+	MissingSince time.Time `json:"missingSince"`
+}
+
+func LoadUserState(filename string) (*UserState, error) {
+	userState := &UserState{filename: filename}
+	if filename != "" {
+		content, err := os.ReadFile(filename)
+		if err == nil {
+			err = json.Unmarshal(content, &userState.state)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse user state file '%s': %v", filename, err)
+			}
+			klog.Infof("Loaded %d user IDs and %d missing users from user state file", len(userState.state.UserIds), len(userState.state.MissingUsers))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if userState.state.MissingUsers == nil {
+		userState.state.MissingUsers = make(map[int64]*MissingUser)
+	}
+	if userState.state.ProvisionedUsers == nil {
+		userState.state.ProvisionedUsers = make(map[int64]bool)
+	}
+	return userState, nil
+}
+
+func (this *UserState) isProvisioned(user grafana.UserSearch) bool {
+	return this != nil && len(user.AuthLabels) == 0 && this.state.ProvisionedUsers[user.ID]
+}
+
+func (this *UserState) isMissing(id int64) bool {
+	return this != nil && this.state.MissingUsers[id] != nil
+}
+
+// Forgets provisioned users who have logged in or don't exist anymore, returns true if any were forgotten
+func (this *UserState) forgetProvisionedUsers(grafanaUsers []grafana.UserSearch) bool {
+	provisionedUsers := make(map[int64]bool)
+	for _, grafanaUser := range grafanaUsers {
+		if this.isProvisioned(grafanaUser) {
+			provisionedUsers[grafanaUser.ID] = true
+		}
+	}
+	if len(provisionedUsers) == len(this.state.ProvisionedUsers) {
+		return false
+	}
+	this.state.ProvisionedUsers = provisionedUsers
+	return true
+}
+
+func (this *UserState) save() error {
+	if this.filename == "" {
+		return nil
+	}
+	content, err := json.Marshal(this.state)
+	if err != nil {
+		return err
+	}
+	tmpFile := this.filename + ".tmp"
+	err = os.WriteFile(tmpFile, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, this.filename)
+}